@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const AUDIO_MAX_UPLOAD_SIZE = 1 << 28 // 256 MB
+const AUDIO_STATIC_DIR = "../static/audio"
+
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".m4a":  true,
+	".aac":  true,
+	".ogg":  true,
+	".opus": true,
+	".wav":  true,
+	".flac": true,
+	".webm": true,
+}
+
+// each user's uploaded files live in a directory named after their db
+func getUserDataDir(dbPath string) string {
+	return strings.TrimSuffix(dbPath, filepath.Ext(dbPath))
+}
+
+func getUserAudioDir(dbPath string) string {
+	return filepath.Join(getUserDataDir(dbPath), "audio")
+}
+
+// upload (or replace) the audio of a story as multipart form field "audio"
+func UploadStoryAudio(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, AUDIO_MAX_UPLOAD_SIZE)
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "could not read uploaded audio: " + err.Error() + `"}`))
+		return
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !audioExtensions[ext] {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "unsupported audio file type: " + ext + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	var oldAudio sql.NullString
+	err = sqldb.QueryRow(`SELECT audio FROM stories WHERE id = $1;`, id).Scan(&oldAudio)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + params["id"] + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+
+	audio := strconv.Itoa(id) + ext
+	err = saveAudioFile(getUserAudioDir(dbPath), audio, file)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	_, err = sqldb.Exec(`UPDATE stories SET audio = $1 WHERE id = $2;`, audio, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to update story audio: " + err.Error() + `"}`))
+		return
+	}
+
+	// an upload with a different extension leaves the previous file behind
+	if oldAudio.String != "" && oldAudio.String != audio && !strings.ContainsRune(oldAudio.String, '/') {
+		os.Remove(filepath.Join(getUserAudioDir(dbPath), oldAudio.String))
+	}
+
+	json.NewEncoder(w).Encode(Story{ID: int64(id), Audio: audio})
+}
+
+// writes to a temp file first so a failed upload doesn't clobber the existing audio
+func saveAudioFile(dir string, name string, src io.Reader) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failure to make audio directory: " + err.Error())
+	}
+
+	tempFile, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failure to create audio file: " + err.Error())
+	}
+	defer os.Remove(tempFile.Name()) // no-op once renamed
+
+	_, err = io.Copy(tempFile, src)
+	if err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failure to write audio file: " + err.Error())
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failure to write audio file: " + err.Error())
+	}
+
+	err = os.Rename(tempFile.Name(), filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("failure to save audio file: " + err.Error())
+	}
+	return nil
+}
+
+// serves the user's uploaded audio, falling back to the shared static audio directory;
+// ServeContent handles Range requests so the player can seek to any line's timestamp
+func GetAudio(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	// cleaning a rooted path drops any ".." that would escape the audio directories
+	name := filepath.Clean("/" + mux.Vars(r)["path"])
+
+	for _, dir := range []string{getUserAudioDir(dbPath), AUDIO_STATIC_DIR} {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			file.Close()
+			continue
+		}
+
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		file.Close()
+		return
+	}
+
+	http.NotFound(w, r)
+}
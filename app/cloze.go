@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// replaces each occurrence of the drilled word in a cloze sentence
+const CLOZE_BLANK = "＿＿"
+
+// the number of sentences given for each word unless the request asks for a different number
+const CLOZE_DEFAULT_MAX_CONTEXTS = 3
+
+// the number of words drilled unless the request asks for a different limit
+const CLOZE_DEFAULT_LIMIT = 20
+
+// for the due words of the requested stories, sentences from any of the user's stories
+// with the word blanked out
+func ClozeDrill(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var clozeRequest ClozeRequest
+	err = json.NewDecoder(r.Body).Decode(&clozeRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	if clozeRequest.Limit < 0 || clozeRequest.MaxContexts < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "invalid cloze limit: " + strconv.Itoa(clozeRequest.Limit) +
+			", max contexts: " + strconv.Itoa(clozeRequest.MaxContexts) + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	clozes, err := getClozes(clozeRequest, time.Now().Unix(), sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	notes, err := getWordNotes(sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	wordInfoMap := make(map[string]WordInfo)
+	for _, cloze := range clozes {
+		wordInfoMap[cloze.Word.BaseForm] = getWordInfo(cloze.Word, notes[cloze.Word.ID])
+	}
+
+	json.NewEncoder(w).Encode(ClozeDrillResult{Clozes: clozes, WordInfoMap: wordInfoMap})
+}
+
+// words which appear in no tokenized story (and so have no sentence to blank) are skipped
+func getClozes(clozeRequest ClozeRequest, now int64, sqldb *sql.DB) ([]Cloze, error) {
+	limit := clozeRequest.Limit
+	if limit == 0 {
+		limit = CLOZE_DEFAULT_LIMIT
+	}
+	maxContexts := clozeRequest.MaxContexts
+	if maxContexts == 0 {
+		maxContexts = CLOZE_DEFAULT_MAX_CONTEXTS
+	}
+
+	drill, err := getDrillWords(DrillRequest{
+		StoryIds:     clozeRequest.StoryIds,
+		Filter:       DRILL_FILTER_OFF_COOLDOWN,
+		CategoryMask: clozeRequest.CategoryMask,
+		MinRank:      clozeRequest.MinRank,
+		MaxRank:      clozeRequest.MaxRank,
+	}, now, sqldb)
+	if err != nil {
+		return nil, err
+	}
+
+	wordIDs := make(map[int64]bool)
+	for _, word := range drill.Words {
+		wordIDs[word.ID] = true
+	}
+
+	contexts, err := getClozeContexts(wordIDs, maxContexts, sqldb)
+	if err != nil {
+		return nil, err
+	}
+
+	clozes := make([]Cloze, 0)
+	for _, word := range drill.Words {
+		if len(contexts[word.ID]) == 0 {
+			continue
+		}
+		clozes = append(clozes, Cloze{Word: word, Contexts: contexts[word.ID]})
+		if len(clozes) == limit {
+			break
+		}
+	}
+	return clozes, nil
+}
+
+// up to maxContexts sentences for each of the words, newest stories first
+func getClozeContexts(wordIDs map[int64]bool, maxContexts int, sqldb *sql.DB) (map[int64][]ClozeContext, error) {
+	contexts := make(map[int64][]ClozeContext)
+
+	rows, err := sqldb.Query(`SELECT id, title, lines FROM stories WHERE is_tokenized = 1 ORDER BY date_added DESC, id DESC;`)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get stories: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var storyID int64
+		var title string
+		var linesJSON sql.NullString
+		if err := rows.Scan(&storyID, &title, &linesJSON); err != nil {
+			return nil, fmt.Errorf("failure to scan story: " + err.Error())
+		}
+		if !linesJSON.Valid {
+			continue
+		}
+		var lines []Line
+		if err := json.Unmarshal([]byte(linesJSON.String), &lines); err != nil {
+			return nil, fmt.Errorf("failure to unmarshall story lines: " + err.Error())
+		}
+
+		for lineIdx, line := range lines {
+			for _, sentence := range lineSentences(line) {
+				// a word used twice in a sentence gives one context
+				seen := make(map[int64]bool)
+				for _, word := range line.Words[sentence.Start:sentence.End] {
+					if !wordIDs[word.ID] || seen[word.ID] || len(contexts[word.ID]) >= maxContexts {
+						continue
+					}
+					seen[word.ID] = true
+					context := clozeSentence(line.Words[sentence.Start:sentence.End], word.ID)
+					context.StoryID = storyID
+					context.StoryTitle = title
+					context.Timestamp = line.Timestamp
+					context.LineIdx = lineIdx
+					contexts[word.ID] = append(contexts[word.ID], context)
+				}
+			}
+		}
+	}
+
+	return contexts, nil
+}
+
+// the line's sentences; lines tokenized before sentences were tracked are one sentence
+func lineSentences(line Line) []LineSentence {
+	sentences := make([]LineSentence, 0)
+	for _, paragraph := range line.Paragraphs {
+		sentences = append(sentences, paragraph.Sentences...)
+	}
+	if len(sentences) == 0 && len(line.Words) > 0 {
+		sentences = append(sentences, LineSentence{Start: 0, End: len(line.Words)})
+	}
+	return sentences
+}
+
+// the sentence's text with every occurrence of the word blanked out
+func clozeSentence(words []LineWord, wordID int64) ClozeContext {
+	context := ClozeContext{Answers: make([]string, 0)}
+	var sb strings.Builder
+	for _, word := range words {
+		if word.ID == wordID {
+			sb.WriteString(CLOZE_BLANK)
+			context.Answers = append(context.Answers, word.Surface)
+		} else {
+			sb.WriteString(word.Surface)
+		}
+	}
+	context.Sentence = strings.TrimSpace(sb.String())
+	return context
+}
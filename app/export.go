@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/ikawaha/kagome/v2/tokenizer"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const EXPORT_FORMAT_SRT = "srt"
+const EXPORT_FORMAT_VTT = "vtt"
+const EXPORT_FORMAT_HTML = "html"
+
+// the last line has no next line to end it, so its cue lasts this many seconds
+const EXPORT_LAST_CUE_DURATION = 5
+
+// same colors as the POS classes in static/styles.css
+const EXPORT_HTML_STYLE = `body {
+    background-color: rgb(35, 35, 35);
+    color: #aabdcf;
+    font-family: "Noto Sans JP", TakaoPGothic, sans-serif;
+    letter-spacing: 0.02em;
+    margin: 2em 4em;
+}
+#story { font-size: 170%; line-height: 2.2; }
+#story p { margin: 0 0 1.1em 0; }
+.timestamp { color: #838383; font-size: 50%; margin-right: 1em; }
+rt { font-size: 45%; color: #838383; }
+a { color: #838383; }
+table { border-collapse: collapse; font-size: 130%; }
+td { padding: 4px 2em 4px 0; }
+.noun { color: #bac4cd; }
+.counter { color: #5798d0; }
+.particle, .conjunction { color: rgb(192, 191, 33); }
+.connecting_particle { color: rgb(127, 124, 4); }
+.verb_auxiliary { color: #9a6565; }
+.adverb { color: #458159; }
+.verb { color: #b64747; }
+.i_adjective { color: #b170be; }
+.pronoun, .admoninal_adjective { color: #5782a9; }
+`
+
+// download the story as subtitles (?format=srt or vtt) or as a standalone html page (?format=html)
+func ExportStory(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = EXPORT_FORMAT_HTML
+	}
+	if format != EXPORT_FORMAT_SRT && format != EXPORT_FORMAT_VTT && format != EXPORT_FORMAT_HTML {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "unsupported export format: " + format + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	story, err := getStory(int64(id), sqldb)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	var exported string
+	var contentType string
+	switch format {
+	case EXPORT_FORMAT_HTML:
+		exported = exportStoryHTML(story)
+		contentType = "text/html; charset=utf-8"
+	default:
+		exported, err = exportStorySubtitles(story, format)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
+		contentType = "text/plain; charset=utf-8"
+		if format == EXPORT_FORMAT_VTT {
+			contentType = "text/vtt; charset=utf-8"
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": exportFilename(story.Title) + "." + format}))
+	w.Write([]byte(exported))
+}
+
+// a title safe to use as a file name
+func exportFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '"' || r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, title)
+	if name == "" {
+		return "story"
+	}
+	return name
+}
+
+// parses the "m:ss" and "m:ss.fff" line timestamps
+func timestampToSeconds(timestamp string) (float64, error) {
+	parts := strings.SplitN(strings.TrimSpace(timestamp), ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid line timestamp: " + timestamp)
+	}
+	minutes, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid line timestamp: " + timestamp)
+	}
+	seconds, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid line timestamp: " + timestamp)
+	}
+	return float64(minutes*60) + seconds, nil
+}
+
+// the text of a line as it reads, with newline tokens collapsed
+func lineSurface(line Line) string {
+	var sb strings.Builder
+	for _, word := range line.Words {
+		sb.WriteString(word.Surface)
+	}
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// each line becomes a cue lasting until the next line starts
+func exportStorySubtitles(story Story, format string) (string, error) {
+	starts := make([]float64, len(story.Lines))
+	hasTimestamps := false
+	for i, line := range story.Lines {
+		seconds, err := timestampToSeconds(line.Timestamp)
+		if err != nil {
+			return "", err
+		}
+		starts[i] = seconds
+		if seconds > 0 {
+			hasTimestamps = true
+		}
+	}
+	if !hasTimestamps {
+		return "", fmt.Errorf("story has no timestamps to export as subtitles")
+	}
+
+	var sb strings.Builder
+	if format == EXPORT_FORMAT_VTT {
+		sb.WriteString("WEBVTT\n\n")
+	}
+
+	cueNum := 1
+	for i, line := range story.Lines {
+		text := lineSurface(line)
+		if text == "" {
+			continue
+		}
+
+		end := starts[i] + EXPORT_LAST_CUE_DURATION
+		if i+1 < len(starts) && starts[i+1] > starts[i] {
+			end = starts[i+1]
+		}
+
+		if format == EXPORT_FORMAT_SRT {
+			sb.WriteString(strconv.Itoa(cueNum) + "\n")
+		}
+		sb.WriteString(formatCueTime(starts[i], format) + " --> " + formatCueTime(end, format) + "\n")
+		sb.WriteString(text + "\n\n")
+		cueNum++
+	}
+
+	return sb.String(), nil
+}
+
+// "hh:mm:ss,mmm" for srt, "hh:mm:ss.mmm" for vtt
+func formatCueTime(seconds float64, format string) string {
+	totalMillis := int64(seconds*1000 + 0.5)
+	hours := totalMillis / (60 * 60 * 1000)
+	minutes := (totalMillis / (60 * 1000)) % 60
+	wholeSeconds := (totalMillis / 1000) % 60
+	millis := totalMillis % 1000
+
+	separator := "."
+	if format == EXPORT_FORMAT_SRT {
+		separator = ","
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", hours, minutes, wholeSeconds, separator, millis)
+}
+
+// the vocabulary appendix lists the story's words with the ranks from story.WordInfo
+func exportStoryHTML(story Story) string {
+	title := html.EscapeString(story.Title)
+
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>" + title + "</title>\n")
+	sb.WriteString("<style>\n" + EXPORT_HTML_STYLE + "</style>\n</head>\n<body>\n")
+	sb.WriteString("<h3>" + title + "</h3>\n")
+	if story.Link != "" {
+		link := html.EscapeString(story.Link)
+		sb.WriteString(`<p><a href="` + link + `">` + link + "</a></p>\n")
+	}
+
+	type vocabWord struct {
+		baseForm string
+		reading  string
+		pos      string
+		rank     int
+	}
+	vocab := make([]vocabWord, 0)
+	seen := make(map[string]bool)
+
+	sb.WriteString("<div id=\"story\">\n")
+	for _, line := range story.Lines {
+		sb.WriteString("<p>")
+		if line.Timestamp != "" && line.Timestamp != "0:00" {
+			sb.WriteString(`<span class="timestamp">` + html.EscapeString(line.Timestamp) + "</span>")
+		}
+		for _, word := range line.Words {
+			if strings.TrimSpace(word.Surface) == "" {
+				if strings.Contains(word.Surface, "\n") {
+					sb.WriteString("<br>")
+				} else {
+					sb.WriteString(html.EscapeString(word.Surface))
+				}
+				continue
+			}
+
+			reading := getWordReading(word)
+			text := rubyText(word.Surface, reading)
+			posClass := ""
+			if pos := strings.Fields(word.POS); len(pos) > 0 {
+				posClass = pos[0]
+				text = `<span class="` + posClass + `">` + text + "</span>"
+			}
+			sb.WriteString(text)
+
+			if word.ID != 0 && !seen[word.BaseForm] {
+				seen[word.BaseForm] = true
+				baseReading := ""
+				if reHasKanji.MatchString(word.BaseForm) {
+					baseReading = getReading(word.BaseForm)
+				}
+				vocab = append(vocab, vocabWord{word.BaseForm, baseReading, posClass, story.WordInfo[word.BaseForm].Rank})
+			}
+		}
+		sb.WriteString("</p>\n")
+	}
+	sb.WriteString("</div>\n")
+
+	// least known words first, otherwise in order of appearance
+	sort.SliceStable(vocab, func(i, j int) bool {
+		return vocab[i].rank < vocab[j].rank
+	})
+
+	sb.WriteString("<h3>VOCABULARY</h3>\n<table>\n<tr><th>word</th><th>reading</th><th>rank</th></tr>\n")
+	for _, word := range vocab {
+		sb.WriteString(`<tr class="` + word.pos + `"><td>` + html.EscapeString(word.baseForm) +
+			"</td><td>" + html.EscapeString(word.reading) +
+			"</td><td>" + strconv.Itoa(word.rank) + "</td></tr>\n")
+	}
+	sb.WriteString("</table>\n</body>\n</html>\n")
+
+	return sb.String()
+}
+
+// stories tokenized before readings were stored get theirs from the tokenizer
+func getWordReading(word LineWord) string {
+	if !reHasKanji.MatchString(word.Surface) {
+		return ""
+	}
+	if word.Reading != "" {
+		return word.Reading
+	}
+	return getReading(word.Surface)
+}
+
+// the hiragana reading of text with kanji
+func getReading(text string) string {
+	var sb strings.Builder
+	for _, token := range tok.Analyze(text, tokenizer.Normal) {
+		features := token.Features()
+		if len(features) < 9 || features[7] == "*" {
+			sb.WriteString(token.Surface)
+			continue
+		}
+		sb.WriteString(features[7])
+	}
+	return katakanaToHiragana(sb.String())
+}
+
+func katakanaToHiragana(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'ァ' && r <= 'ヶ' {
+			return r - ('ァ' - 'ぁ')
+		}
+		return r
+	}, s)
+}
+
+// ruby over the kanji part of the surface only, e.g. 食<rt>た</rt>べる
+func rubyText(surface string, reading string) string {
+	if reading == "" || reading == surface {
+		return html.EscapeString(surface)
+	}
+
+	surfaceRunes := []rune(surface)
+	readingRunes := []rune(reading)
+
+	// kana before and after the kanji read the same in the surface and the reading
+	prefix := 0
+	for prefix < len(surfaceRunes) && prefix < len(readingRunes) &&
+		katakanaToHiragana(string(surfaceRunes[prefix])) == string(readingRunes[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(surfaceRunes)-prefix && suffix < len(readingRunes)-prefix &&
+		katakanaToHiragana(string(surfaceRunes[len(surfaceRunes)-1-suffix])) == string(readingRunes[len(readingRunes)-1-suffix]) {
+		suffix++
+	}
+
+	base := string(surfaceRunes[prefix : len(surfaceRunes)-suffix])
+	rt := string(readingRunes[prefix : len(readingRunes)-suffix])
+	if base == "" || rt == "" {
+		return html.EscapeString(surface)
+	}
+
+	return html.EscapeString(string(surfaceRunes[:prefix])) +
+		"<ruby>" + html.EscapeString(base) + "<rt>" + html.EscapeString(rt) + "</rt></ruby>" +
+		html.EscapeString(string(surfaceRunes[len(surfaceRunes)-suffix:]))
+}
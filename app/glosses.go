@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// how the searched words appear in a gloss, best first
+const GLOSS_MATCH_WHOLE = 0
+const GLOSS_MATCH_START = 1
+const GLOSS_MATCH_INSIDE = 2
+
+var glossMatchNames = []string{"whole", "start", "inside"}
+
+// the number of matches returned unless the search asks for a different limit
+const GLOSS_SEARCH_DEFAULT_LIMIT = 50
+
+// larger limits are capped, keeping the known words lookup within SQLite's limit on bound variables
+const GLOSS_SEARCH_MAX_LIMIT = GLOSS_SEARCH_DEFAULT_LIMIT * 4
+
+// the glosses of allEntries containing each (stemmed) token
+var glossIndex map[string][]glossRef
+
+type glossRef struct {
+	entry int32
+	sense int32
+	gloss int32
+}
+
+// built after allEntries is loaded
+func buildGlossIndex() {
+	glossIndex = make(map[string][]glossRef)
+	for i, entry := range allEntries.Entries {
+		for j, sense := range entry.Senses {
+			for k, gloss := range sense.Gloss {
+				seen := make(map[string]bool)
+				for _, token := range glossTokens(gloss.Value) {
+					if !seen[token] {
+						seen[token] = true
+						glossIndex[token] = append(glossIndex[token], glossRef{entry: int32(i), sense: int32(j), gloss: int32(k)})
+					}
+				}
+			}
+		}
+	}
+}
+
+// the text's words, case folded and stemmed; a leading "to" (of a verb) or article is
+// dropped so that "eat" matches the whole of "to eat"
+func glossTokens(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if token := stem(strings.Trim(word, "'")); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) > 1 {
+		switch tokens[0] {
+		case "to", "a", "an", "the":
+			tokens = tokens[1:]
+		}
+	}
+	return tokens
+}
+
+// a light stemmer for plurals and -ing forms, applied alike to glosses and searches, so
+// the stems needn't be words: "cities" and "city" are "city", "boxes" and "box" are "box",
+// "making" and "make" are "mak", "running" and "run" are "run"
+func stem(word string) string {
+	word = strings.TrimSuffix(word, "'s")
+
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-3] + "y"
+	case len(word) > 4 && (strings.HasSuffix(word, "sses") || strings.HasSuffix(word, "xes") ||
+		strings.HasSuffix(word, "ches") || strings.HasSuffix(word, "shes") || strings.HasSuffix(word, "zes")):
+		word = word[:len(word)-2]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		word = word[:len(word)-1]
+	}
+
+	if len(word) > 5 && strings.HasSuffix(word, "ing") {
+		word = word[:len(word)-3]
+		// running -> run, but calling -> call
+		if n := len(word); word[n-1] == word[n-2] && !strings.ContainsRune("aeiouylsz", rune(word[n-1])) {
+			word = word[:n-1]
+		}
+	}
+
+	if len(word) > 3 && strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "ee") {
+		word = word[:len(word)-1]
+	}
+	return word
+}
+
+// GLOSS_MATCH_WHOLE, _START or _INSIDE, or -1 if the search's tokens aren't in the gloss's
+func glossMatch(glossTokens []string, searchTokens []string) int {
+	for start := 0; start+len(searchTokens) <= len(glossTokens); start++ {
+		matches := true
+		for i, token := range searchTokens {
+			if glossTokens[start+i] != token {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if start > 0 {
+			return GLOSS_MATCH_INSIDE
+		}
+		if len(searchTokens) == len(glossTokens) {
+			return GLOSS_MATCH_WHOLE
+		}
+		return GLOSS_MATCH_START
+	}
+	return -1
+}
+
+// English to Japanese: the entries with a gloss containing the searched words, ranked by how
+// they match the gloss, then commonness; words already in the user's words are flagged
+func PostGlossSearch(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var glossSearch GlossSearch
+	err = json.NewDecoder(r.Body).Decode(&glossSearch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	if glossSearch.Offset < 0 || glossSearch.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "invalid search offset: " + strconv.Itoa(glossSearch.Offset) +
+			", limit: " + strconv.Itoa(glossSearch.Limit) + `"}`))
+		return
+	}
+	limit := glossSearch.Limit
+	if limit == 0 {
+		limit = GLOSS_SEARCH_DEFAULT_LIMIT
+	}
+	if limit > GLOSS_SEARCH_MAX_LIMIT {
+		limit = GLOSS_SEARCH_MAX_LIMIT
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	result := searchGlosses(glossSearch.Query, glossSearch.Offset, limit)
+
+	err = flagKnownWords(result.Matches, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func searchGlosses(query string, offset int, limit int) GlossSearchResult {
+	result := GlossSearchResult{Matches: make([]GlossMatch, 0)}
+
+	searchTokens := glossTokens(query)
+	if len(searchTokens) == 0 {
+		return result
+	}
+
+	// only the glosses containing the search's least common token need be checked
+	var refs []glossRef
+	for i, token := range searchTokens {
+		if i == 0 || len(glossIndex[token]) < len(refs) {
+			refs = glossIndex[token]
+		}
+	}
+
+	// each entry's best matching gloss
+	type candidate struct {
+		entry     int32
+		sense     int32
+		match     int
+		gloss     string
+		glossSize int
+	}
+	best := make(map[int32]*candidate)
+	for _, ref := range refs {
+		gloss := allEntries.Entries[ref.entry].Senses[ref.sense].Gloss[ref.gloss].Value
+		tokens := glossTokens(gloss)
+		match := glossMatch(tokens, searchTokens)
+		if match < 0 {
+			continue
+		}
+		c := &candidate{entry: ref.entry, sense: ref.sense, match: match, gloss: gloss, glossSize: len(tokens)}
+		if b, ok := best[ref.entry]; !ok || c.match < b.match ||
+			(c.match == b.match && (c.sense < b.sense || (c.sense == b.sense && c.glossSize < b.glossSize))) {
+			best[ref.entry] = c
+		}
+	}
+
+	candidates := make([]*candidate, 0, len(best))
+	for _, c := range best {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.match != b.match {
+			return a.match < b.match
+		}
+		if commonnessA, commonnessB := allEntries.Entries[a.entry].Commonness, allEntries.Entries[b.entry].Commonness; commonnessA != commonnessB {
+			return commonnessA > commonnessB
+		}
+		if a.sense != b.sense {
+			return a.sense < b.sense
+		}
+		if a.glossSize != b.glossSize {
+			return a.glossSize < b.glossSize
+		}
+		return a.entry < b.entry
+	})
+
+	result.Count = len(candidates)
+	if offset > len(candidates) {
+		offset = len(candidates)
+	}
+	end := offset + limit
+	if end > len(candidates) {
+		end = len(candidates)
+	}
+	for _, c := range candidates[offset:end] {
+		result.Matches = append(result.Matches, GlossMatch{
+			Entry: allEntries.Entries[c.entry],
+			Match: glossMatchNames[c.match],
+			Gloss: c.gloss,
+		})
+	}
+	return result
+}
+
+// sets the known word of each match whose kanji spelling (or for entries without kanji
+// spellings, reading) is in the user's words; the reading of a kanji word would also match
+// its homophones (e.g. かみ would flag 神, 紙 and 髪)
+func flagKnownWords(matches []GlossMatch, sqldb *sql.DB) error {
+	forms := make([]interface{}, 0)
+	placeholders := ""
+	for _, match := range matches {
+		for _, form := range knownWordForms(match.Entry) {
+			forms = append(forms, form)
+		}
+	}
+	if len(forms) == 0 {
+		return nil
+	}
+	for i := range forms {
+		if i > 0 {
+			placeholders += ", "
+		}
+		placeholders += "$" + strconv.Itoa(i+1)
+	}
+
+	rows, err := sqldb.Query(`SELECT base_form, rank FROM words WHERE base_form IN (`+placeholders+`);`, forms...)
+	if err != nil {
+		return fmt.Errorf("failure to get known words: " + err.Error())
+	}
+	defer rows.Close()
+
+	ranks := make(map[string]int)
+	for rows.Next() {
+		var baseForm string
+		var rank int
+		if err := rows.Scan(&baseForm, &rank); err != nil {
+			return fmt.Errorf("failure to scan known word: " + err.Error())
+		}
+		ranks[baseForm] = rank
+	}
+
+	for i := range matches {
+		for _, form := range knownWordForms(matches[i].Entry) {
+			if rank, ok := ranks[form]; ok {
+				matches[i].KnownWord = form
+				matches[i].Rank = rank
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// the kanji spellings, or the readings of an entry without any
+func knownWordForms(entry JMDictEntry) []string {
+	forms := make([]string, 0)
+	for _, k_ele := range entry.KanjiSpellings {
+		forms = append(forms, k_ele.KanjiSpelling)
+	}
+	if len(forms) > 0 {
+		return forms
+	}
+	for _, r_ele := range entry.Readings {
+		forms = append(forms, r_ele.Reading)
+	}
+	return forms
+}
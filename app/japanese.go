@@ -6,7 +6,9 @@ import (
 	"math"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	"crypto/md5"
@@ -33,6 +35,7 @@ var allEntries JMDict
 var allEntriesByReading map[string][]*JMDictEntry
 var allEntriesByKanjiSpellings map[string][]*JMDictEntry
 
+var definitionsCacheMutex sync.Mutex
 var definitionsCache map[string][]JMDictEntry // base form to []JMDictEntry
 //var definitionsJSONCache map[string]string    // base form to JSON string of []JMDictEntry
 
@@ -78,6 +81,7 @@ func main() {
 
 	makeMainDB()
 	initialize()
+	startTokenizeWorker()
 
 	start := time.Now()
 	bytes, err := unzipSource("../kanji.zip")
@@ -115,6 +119,14 @@ func main() {
 	duration = time.Since(start)
 	fmt.Println("time to build entry maps: ", duration)
 
+	start = time.Now()
+	buildSearchIndexes()
+	buildGlossIndex()
+	fmt.Println("time to build search indexes: ", time.Since(start))
+
+	// stories whose tokenizing was interrupted by a shutdown or crash
+	requeueUntokenizedStories()
+
 	// [START setting_port]
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -135,9 +147,26 @@ func main() {
 	router.HandleFunc("/register", PostRegisterUser).Methods("POST")
 	router.HandleFunc("/word_search", PostWordSearch).Methods("POST")
 	router.HandleFunc("/word_type_search", PostWordTypeSearch).Methods("POST")
+	router.HandleFunc("/gloss_search", PostGlossSearch).Methods("POST")
 	router.HandleFunc("/update_story_counts", UpdateStoryCounts).Methods("POST")
+	router.HandleFunc("/update_story_status", UpdateStoryStatus).Methods("POST")
+	router.HandleFunc("/story_status_history/{id}", GetStoryStatusHistory).Methods("GET")
+	router.HandleFunc("/add_log_event/{id}", AddLogEvent).Methods("GET")
+	router.HandleFunc("/log_events", GetLogEvents).Methods("GET")
+	router.HandleFunc("/log_events/{id}", GetLogEvents).Methods("GET")
+	router.HandleFunc("/queue", GetQueue).Methods("GET")
+	router.HandleFunc("/enqueue_story", EnqueueStory).Methods("POST")
+	router.HandleFunc("/reorder_queue", ReorderQueue).Methods("POST")
+	router.HandleFunc("/dequeue", Dequeue).Methods("POST")
 	router.HandleFunc("/create_story", CreateStory).Methods("POST")
 	router.HandleFunc("/retokenize_story", RetokenizeStory).Methods("POST")
+	router.HandleFunc("/edit_story", EditStory).Methods("POST")
+	router.HandleFunc("/import_subtitles", ImportSubtitles).Methods("POST")
+	router.HandleFunc("/export_story/{id}", ExportStory).Methods("GET")
+	router.HandleFunc("/delete_story", DeleteStory).Methods("POST")
+	router.HandleFunc("/tokenize_status/{id}", GetTokenizeStatus).Methods("GET")
+	router.HandleFunc("/story_audio/{id}", UploadStoryAudio).Methods("POST")
+	router.HandleFunc("/audio/{path:.+}", GetAudio).Methods("GET")
 	router.HandleFunc("/story/{id}", GetStory).Methods("GET")
 	router.HandleFunc("/story_consolidate_line", ConsolidateLine).Methods("POST")
 	router.HandleFunc("/story_split_line", SplitLine).Methods("POST")
@@ -147,6 +176,17 @@ func main() {
 	router.HandleFunc("/kanji", Kanji).Methods("POST")
 	router.HandleFunc("/words", WordDrill).Methods("POST")
 	router.HandleFunc("/update_word", UpdateWord).Methods("POST")
+	router.HandleFunc("/update_words", UpdateWords).Methods("POST")
+	router.HandleFunc("/drill_kanji", KanjiDrill).Methods("POST")
+	router.HandleFunc("/update_kanji", UpdateKanji).Methods("POST")
+	router.HandleFunc("/word_reviews/{baseForm}", GetWordReviews).Methods("GET")
+	router.HandleFunc("/word_note", UpdateWordNote).Methods("POST")
+	router.HandleFunc("/drill_stats", GetDrillStats).Methods("GET")
+	router.HandleFunc("/leeches", GetLeeches).Methods("GET")
+	router.HandleFunc("/update_leech", UpdateLeech).Methods("POST")
+	router.HandleFunc("/cloze", ClozeDrill).Methods("POST")
+	router.HandleFunc("/settings", GetSettings).Methods("GET")
+	router.HandleFunc("/settings", UpdateSettings).Methods("POST")
 	router.HandleFunc("/", GetMain).Methods("GET")
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("../static")))
 
@@ -196,6 +236,8 @@ func buildEntryMaps() {
 				}
 			}
 		}
+
+		allEntries.Entries[i].Commonness = entryCommonness(entry)
 	}
 }
 
@@ -235,10 +277,10 @@ func makeMainDB() {
 
 }
 
-func makeUserDB(userhash string) {
+func makeUserDB(userhash string) error {
 	sqldb, err := sql.Open("sqlite3", "../users/"+userhash+".db")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer sqldb.Close()
 
@@ -251,10 +293,10 @@ func makeUserDB(userhash string) {
 			date_added INTEGER NOT NULL,
 			rank INTEGER NOT NULL)`)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if _, err := statement.Exec(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS stories 
@@ -267,13 +309,206 @@ func makeUserDB(userhash string) {
 			date_last_read INTEGER,
 			status INTEGER NOT NULL,
 			audio	TEXT,
-			date_added INTEGER NOT NULL)`)
+			date_added INTEGER NOT NULL,
+			content TEXT,
+			is_tokenized INTEGER NOT NULL DEFAULT 1)`)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if _, err := statement.Exec(); err != nil {
-		log.Fatal(err)
+		return err
+	}
+	// stories created before background tokenizing are all tokenized
+	if err := addColumnIfMissing(sqldb, "stories", "content", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(sqldb, "stories", "is_tokenized", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	// lapses count wrong answers to words last answered correctly
+	for column, definition := range map[string]string{
+		"lapses":    "INTEGER NOT NULL DEFAULT 0",
+		"leech":     "INTEGER NOT NULL DEFAULT 0",
+		"suspended": "INTEGER NOT NULL DEFAULT 0",
+	} {
+		if err := addColumnIfMissing(sqldb, "words", column, definition); err != nil {
+			return err
+		}
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS log_events 
+		(id INTEGER PRIMARY KEY,
+			story INTEGER NOT NULL,
+			date INTEGER NOT NULL,
+			FOREIGN KEY(story) REFERENCES stories(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS queued_stories 
+		(id INTEGER PRIMARY KEY,
+			story INTEGER NOT NULL,
+			date INTEGER NOT NULL,
+			position INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(story) REFERENCES stories(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS story_status_changes 
+		(id INTEGER PRIMARY KEY,
+			story INTEGER NOT NULL,
+			old_status INTEGER NOT NULL,
+			new_status INTEGER NOT NULL,
+			date INTEGER NOT NULL,
+			FOREIGN KEY(story) REFERENCES stories(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS reviews 
+		(id INTEGER PRIMARY KEY,
+			word INTEGER NOT NULL,
+			date INTEGER NOT NULL,
+			correct INTEGER NOT NULL,
+			old_rank INTEGER NOT NULL,
+			new_rank INTEGER NOT NULL,
+			FOREIGN KEY(word) REFERENCES words(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	// each scheduler keeps its own state so switching schedulers doesn't lose progress
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS word_schedules 
+		(word INTEGER NOT NULL,
+			scheduler TEXT NOT NULL,
+			ease REAL NOT NULL DEFAULT 0,
+			interval REAL NOT NULL DEFAULT 0,
+			stability REAL NOT NULL DEFAULT 0,
+			difficulty REAL NOT NULL DEFAULT 0,
+			repetitions INTEGER NOT NULL DEFAULT 0,
+			due INTEGER NOT NULL DEFAULT 0,
+			last_review INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY(word, scheduler),
+			FOREIGN KEY(word) REFERENCES words(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS word_notes 
+		(word INTEGER PRIMARY KEY,
+			note TEXT NOT NULL DEFAULT '',
+			mnemonic TEXT NOT NULL DEFAULT '',
+			gloss TEXT NOT NULL DEFAULT '',
+			primary_entry TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY(word) REFERENCES words(id))`)
+	if err != nil {
+		return err
+	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	// the migration creates the kanji tables in its transaction, so a failed migration is
+	// retried at the next login rather than leaving the kanji in the words table
+	migrate, err := kanjiMigrationPending(sqldb)
+	if err != nil {
+		return err
+	}
+	if migrate {
+		if err := migrateKanji(sqldb); err != nil {
+			return err
+		}
+	}
+
+	statement, err = sqldb.Prepare(`CREATE TABLE IF NOT EXISTS settings 
+		(id INTEGER PRIMARY KEY,
+			scheduler TEXT NOT NULL)`)
+	if err != nil {
+		return err
 	}
+	if _, err := statement.Exec(); err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(sqldb, "settings", "rank_count", "INTEGER NOT NULL DEFAULT "+strconv.Itoa(DEFAULT_RANK_COUNT))
+	if err != nil {
+		return err
+	}
+	// JSON list of seconds; empty means the default cooldowns
+	err = addColumnIfMissing(sqldb, "settings", "cooldowns", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(sqldb, "settings", "leech_threshold", "INTEGER NOT NULL DEFAULT "+strconv.Itoa(DEFAULT_LEECH_THRESHOLD))
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing(sqldb, "settings", "suspend_leeches", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	_, err = sqldb.Exec(`INSERT OR IGNORE INTO settings (id, scheduler) VALUES($1, $2);`,
+		SETTINGS_ROW_ID, DEFAULT_SCHEDULER)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func tableExists(sqldb *sql.DB, table string) (bool, error) {
+	var count int
+	err := sqldb.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1;`, table).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failure to look up table " + table + ": " + err.Error())
+	}
+	return count > 0, nil
+}
+
+// sqlite has no ADD COLUMN IF NOT EXISTS, so check the table's columns first
+func addColumnIfMissing(sqldb *sql.DB, table string, column string, definition string) error {
+	rows, err := sqldb.Query(`PRAGMA table_info(` + table + `);`)
+	if err != nil {
+		return fmt.Errorf("failure to get columns of table " + table + ": " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failure to scan column of table " + table + ": " + err.Error())
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = sqldb.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition + `;`)
+	if err != nil {
+		return fmt.Errorf("failure to add column " + column + " to table " + table + ": " + err.Error())
+	}
+	return nil
 }
 
 // [END main_func]
@@ -378,6 +613,13 @@ func PostLoginAuth(w http.ResponseWriter, r *http.Request) {
 	userDbPath := "../users/" + hex.EncodeToString(hash[:]) + ".db"
 	session.Values["user_db_path"] = userDbPath
 
+	// bring older user DBs up to date with any newly added tables
+	err = makeUserDB(hex.EncodeToString(hash[:]))
+	if err != nil {
+		http.Error(w, "failure to update user db: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	err = session.Save(r, w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -452,7 +694,12 @@ func PostRegisterUser(response http.ResponseWriter, request *http.Request) {
 
 	// create user DB
 	bytes := md5.Sum([]byte(email))
-	makeUserDB(hex.EncodeToString(bytes[:]))
+	err = makeUserDB(hex.EncodeToString(bytes[:]))
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write([]byte(`{ "message": "` + "failure to create user db: " + err.Error() + `"}`))
+		return
+	}
 
 	// var cookie = http.Cookie{Name: "user", Value: "test", Expires: time.Now().Add(365 * 24 * time.Hour)}
 	// http.SetCookie(response, &cookie)
@@ -468,71 +715,21 @@ func PostWordSearch(response http.ResponseWriter, request *http.Request) {
 
 	fmt.Printf("\nword search: %v\n", wordSearch.Word)
 
-	var re = regexp.MustCompile(`[\x{4E00}-\x{9FAF}]`)
-	kanji := re.FindAllString(wordSearch.Word, -1)
-	hasKanji := len(re.FindStringIndex(wordSearch.Word)) > 0
-
-	reStart := regexp.MustCompile(`^` + wordSearch.Word)
-	entriesStart := make([]JMDictEntry, 0)
-	entriesMid := make([]JMDictEntry, 0)
-
-	if hasKanji { // if has kanji
-		for _, entry := range allEntries.Entries {
-			start := false
-			interior := false
-			for _, kanjiSpelling := range entry.KanjiSpellings {
-				if reStart.MatchString(kanjiSpelling.KanjiSpelling) { // todo regex "^word"
-					start = true
-				} else if strings.Contains(kanjiSpelling.KanjiSpelling, wordSearch.Word) {
-					interior = true
-				}
-			}
-			if start {
-				entriesStart = append(entriesStart, entry)
-			} else if interior {
-				entriesMid = append(entriesMid, entry)
-			}
-		}
-	} else {
-		for _, entry := range allEntries.Entries {
-			start := false
-			interior := false
-			for _, reading := range entry.Readings {
-				if reStart.MatchString(reading.Reading) { // todo regex "^word"
-					start = true
-				} else if strings.Contains(reading.Reading, wordSearch.Word) {
-					interior = true
-				}
-			}
-			if start {
-				entriesStart = append(entriesStart, entry)
-			} else if interior {
-				entriesMid = append(entriesMid, entry)
-			}
-		}
+	if wordSearch.Offset < 0 || wordSearch.Limit < 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(`{ "message": "` + "invalid search offset: " + strconv.Itoa(wordSearch.Offset) +
+			", limit: " + strconv.Itoa(wordSearch.Limit) + `"}`))
+		return
 	}
-
-	kanjiCharacters := getKanji(kanji)
-
-	sortResults(entriesStart, hasKanji, wordSearch.Word)
-	sortResults(entriesMid, hasKanji, wordSearch.Word)
-
-	nEntriesStart := len(entriesStart)
-	if len(entriesStart) > 50 {
-		entriesStart = entriesStart[:50]
+	limit := wordSearch.Limit
+	if limit == 0 {
+		limit = WORD_SEARCH_DEFAULT_LIMIT
 	}
 
-	nEntriesMid := len(entriesMid)
-	if len(entriesMid) > 50 {
-		entriesMid = entriesMid[:50]
-	}
+	result := searchEntries(wordSearch.Word, wordSearch.Offset, limit)
+	result.Kanji = getKanji(reHasKanji.FindAllString(wordSearch.Word, -1))
 
-	json.NewEncoder(response).Encode(bson.M{
-		"entries_start": entriesStart,
-		"count_start":   nEntriesStart,
-		"entries_mid":   entriesMid,
-		"count_mid":     nEntriesMid,
-		"kanji":         kanjiCharacters})
+	json.NewEncoder(response).Encode(result)
 }
 
 func PostWordTypeSearch(response http.ResponseWriter, request *http.Request) {
@@ -565,37 +762,93 @@ func PostWordTypeSearch(response http.ResponseWriter, request *http.Request) {
 	json.NewEncoder(response).Encode(bson.M{"entries": entries})
 }
 
-func sortResults(entries []JMDictEntry, hasKanji bool, word string) {
-	// compute shortest readings and kanji spellings
-	// TODO this could be stored in the DB
-	for i := range entries {
-		entries[i].ShortestKanjiSpelling = math.MaxInt32
-		entries[i].ShortestReading = math.MaxInt32
-		for _, ele := range entries[i].KanjiSpellings {
-			if strings.Contains(ele.KanjiSpelling, word) {
-				count := utf8.RuneCountInString(ele.KanjiSpelling)
-				if count < entries[i].ShortestKanjiSpelling {
-					entries[i].ShortestKanjiSpelling = count
-				}
+// the lengths of the entry's shortest kanji spelling and reading containing the word,
+// math.MaxInt32 if none do
+func shortestMatches(entry *JMDictEntry, word string) (kanjiSpelling int, reading int) {
+	kanjiSpelling, reading = math.MaxInt32, math.MaxInt32
+	for _, ele := range entry.KanjiSpellings {
+		if strings.Contains(ele.KanjiSpelling, word) {
+			if count := utf8.RuneCountInString(ele.KanjiSpelling); count < kanjiSpelling {
+				kanjiSpelling = count
+			}
+		}
+	}
+	for _, ele := range entry.Readings {
+		if strings.Contains(ele.Reading, word) {
+			if count := utf8.RuneCountInString(ele.Reading); count < reading {
+				reading = count
 			}
 		}
-		for _, ele := range entries[i].Readings {
-			if strings.Contains(ele.Reading, word) {
-				count := utf8.RuneCountInString(ele.Reading)
-				if count < entries[i].ShortestReading {
-					entries[i].ShortestReading = count
+	}
+	return kanjiSpelling, reading
+}
+
+// sorts the entries in place; the entries themselves are shared (e.g. with allEntries), so
+// are left unmodified
+func sortResults(entries []*JMDictEntry, hasKanji bool, word string) {
+	shortest := make(map[*JMDictEntry]int, len(entries))
+	for _, entry := range entries {
+		kanjiSpelling, reading := shortestMatches(entry, word)
+		if hasKanji {
+			shortest[entry] = kanjiSpelling
+		} else {
+			shortest[entry] = reading
+		}
+	}
+
+	// exact matches first, then the most common, then the shortest
+	wordLength := utf8.RuneCountInString(word)
+	sort.SliceStable(entries, func(i, j int) bool {
+		exactI, exactJ := shortest[entries[i]] == wordLength, shortest[entries[j]] == wordLength
+		if exactI != exactJ {
+			return exactI
+		}
+		if entries[i].Commonness != entries[j].Commonness {
+			return entries[i].Commonness > entries[j].Commonness
+		}
+		return shortest[entries[i]] < shortest[entries[j]]
+	})
+}
+
+// JMdict marks the common words with priority tags: news1/2 (from a newspaper word frequency
+// list), ichi1/2 (the Ichimango word list), spec1/2 and gai1/2 (common words and loanwords
+// not in the other lists), and nfXX (the 500 word bucket of the newspaper list, nf01 being
+// the most frequent). The 1 tags mark the more common half of each list.
+const PRIORITY_SCORE_1 = 50
+const PRIORITY_SCORE_2 = 20
+const PRIORITY_NF_BUCKETS = 48
+
+func priorityScore(priorities []string) int {
+	score := 0
+	for _, priority := range priorities {
+		switch priority {
+		case "news1", "ichi1", "spec1", "gai1":
+			score += PRIORITY_SCORE_1
+		case "news2", "ichi2", "spec2", "gai2":
+			score += PRIORITY_SCORE_2
+		default:
+			if strings.HasPrefix(priority, "nf") {
+				if bucket, err := strconv.Atoi(priority[2:]); err == nil && bucket > 0 && bucket <= PRIORITY_NF_BUCKETS {
+					score += PRIORITY_NF_BUCKETS + 1 - bucket
 				}
 			}
 		}
 	}
+	return score
+}
 
-	if hasKanji {
-		sort.Slice(entries, func(i, j int) bool {
-			return entries[i].ShortestKanjiSpelling < entries[j].ShortestKanjiSpelling
-		})
-	} else {
-		sort.Slice(entries, func(i, j int) bool {
-			return entries[i].ShortestReading < entries[j].ShortestReading
-		})
+// the score of the entry's most common spelling or reading; 0 for entries with no priority
+func entryCommonness(entry JMDictEntry) int {
+	commonness := 0
+	for _, k_ele := range entry.KanjiSpellings {
+		if score := priorityScore(k_ele.Ke_pri); score > commonness {
+			commonness = score
+		}
+	}
+	for _, r_ele := range entry.Readings {
+		if score := priorityScore(r_ele.Re_pri); score > commonness {
+			commonness = score
+		}
 	}
+	return commonness
 }
@@ -18,13 +18,17 @@ import (
 	//	"net/http"
 	//	"net/http/httptest"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	//"log"
 	// "net/http"
 	// "net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/ikawaha/kagome-dict/ipa"
 	"github.com/ikawaha/kagome/v2/tokenizer"
@@ -41,7 +45,9 @@ func setup(t *testing.T) {
 		panic(err)
 	}
 	initialize()
-	makeUserDB(USERHASH)
+	if err := makeUserDB(USERHASH); err != nil {
+		panic(err)
+	}
 }
 
 func teardown(t *testing.T) {
@@ -117,3 +123,1625 @@ func TestAddAndGetStory(t *testing.T) {
 		t.Error("fail get story: ", err)
 	}
 }
+
+func TestStoryStatusTransitions(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Status Story", Link: "http://example.com/status", Content: "春のとても暖かい日でした"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	if isValidStatusTransition(STORY_STATUS_ARCHIVE, STORY_STATUS_NEVER_READ) {
+		t.Error("archived story should not become never read")
+	}
+
+	story, err := setStoryStatus(id, STORY_STATUS_NEVER_READ, STORY_STATUS_CURRENT, 0, sqldb)
+	if err != nil {
+		t.Fatal("fail set story status: ", err)
+	}
+	if story.Status != STORY_STATUS_CURRENT || story.Countdown != STORY_DEFAULT_COUNTDOWN {
+		t.Errorf("expected current story with default countdown, got status %d countdown %d", story.Status, story.Countdown)
+	}
+
+	baseForms, err := getStoryWords([]int64{-1}, sqldb)
+	if err != nil {
+		t.Fatal("fail get story words: ", err)
+	}
+	if len(baseForms) == 0 {
+		t.Error("current story should contribute words to the current drill")
+	}
+
+	// a change based on a status the story no longer has
+	if _, err = setStoryStatus(id, STORY_STATUS_ARCHIVE, STORY_STATUS_CURRENT, 0, sqldb); !errors.Is(err, errStatusChanged) {
+		t.Errorf("expected a stale status to be rejected, got %v", err)
+	}
+
+	story, err = setStoryStatus(id, STORY_STATUS_CURRENT, STORY_STATUS_ARCHIVE, story.Countdown, sqldb)
+	if err != nil {
+		t.Fatal("fail set story status: ", err)
+	}
+	if story.Countdown != 0 {
+		t.Error("archived story should have no countdown")
+	}
+
+	baseForms, err = getStoryWords([]int64{-1}, sqldb)
+	if err != nil {
+		t.Fatal("fail get story words: ", err)
+	}
+	if len(baseForms) != 0 {
+		t.Error("archived story should not contribute words to the current drill")
+	}
+
+	changes, err := getStoryStatusHistory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story status history: ", err)
+	}
+	if len(changes) != 2 || changes[1].NewStatus != STORY_STATUS_ARCHIVE {
+		t.Errorf("expected two recorded status changes, got %v", changes)
+	}
+}
+
+func TestLogEventCooldown(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Log Story", Link: "http://example.com/log", Content: "3人は船に乗りました"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	_, err = setStoryStatus(id, STORY_STATUS_NEVER_READ, STORY_STATUS_CURRENT, 2, sqldb)
+	if err != nil {
+		t.Fatal("fail set story status: ", err)
+	}
+
+	now := int64(1700000000)
+	story, logged, err := addLogEvent(id, now, sqldb)
+	if err != nil || !logged {
+		t.Fatal("fail add log event: ", err)
+	}
+	if story.Countdown != 1 || story.ReadCount != 1 || story.DateLastRead != now {
+		t.Errorf("unexpected story counts after read: %+v", story)
+	}
+
+	_, logged, err = addLogEvent(id, now+60, sqldb)
+	if err != nil {
+		t.Fatal("fail add log event: ", err)
+	}
+	if logged {
+		t.Error("read within the cooldown should be rejected")
+	}
+
+	story, logged, err = addLogEvent(id, now+STORY_LOG_COOLDOWN+1, sqldb)
+	if err != nil || !logged {
+		t.Fatal("read after the cooldown should be logged: ", err)
+	}
+	if story.Countdown != 0 || story.ReadCount != 2 {
+		t.Errorf("unexpected story counts after second read: %+v", story)
+	}
+
+	events, err := getLogEvents(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get log events: ", err)
+	}
+	if len(events) != 2 || events[0].Title != "Log Story" {
+		t.Errorf("expected two log events, got %v", events)
+	}
+}
+
+func TestStoryQueue(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	idA, _, err := addStory(Story{Title: "Queue A", Link: "http://example.com/a", Content: "飴玉"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	idB, _, err := addStory(Story{Title: "Queue B", Link: "http://example.com/b", Content: "ちょっと待ってくれ"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	if err := enqueueStory(idA, 2, sqldb); err != nil {
+		t.Fatal("fail enqueue: ", err)
+	}
+	if err := enqueueStory(idB, 1, sqldb); err != nil {
+		t.Fatal("fail enqueue: ", err)
+	}
+
+	queue, err := getQueue(0, sqldb)
+	if err != nil || len(queue) != 3 {
+		t.Fatalf("expected three queue entries, got %v (%v)", queue, err)
+	}
+
+	// move B to the front
+	ids := []int64{queue[2].ID, queue[0].ID, queue[1].ID}
+	if isQueuePermutation(queue, ids[:2]) {
+		t.Error("partial reorder should be rejected")
+	}
+	if err := reorderQueue(ids, sqldb); err != nil {
+		t.Fatal("fail reorder: ", err)
+	}
+
+	queue, err = getQueue(1, sqldb)
+	if err != nil || len(queue) != 1 || queue[0].StoryID != idB {
+		t.Fatalf("expected story B next, got %v (%v)", queue, err)
+	}
+
+	if _, _, err := addLogEvent(idA, 1700000000, sqldb); err != nil {
+		t.Fatal("fail add log event: ", err)
+	}
+
+	queue, err = getQueue(0, sqldb)
+	if err != nil || len(queue) != 2 || queue[0].StoryID != idB || queue[1].StoryID != idA {
+		t.Errorf("reading story A should dequeue one of its entries, got %v (%v)", queue, err)
+	}
+}
+
+func TestDeleteStory(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	_, _, err = addStory(Story{Title: "Keep", Link: "http://example.com/keep", Content: "船に乗りました"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	id, _, err := addStory(Story{Title: "Delete", Link: "http://example.com/delete", Content: "船で物語を読みます"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	// a drilled word unique to the story must survive
+	_, err = sqldb.Exec(`UPDATE words SET rank = 2, date_marked = 1700000000 WHERE base_form = $1;`, "読む")
+	if err != nil {
+		t.Fatal("fail mark word: ", err)
+	}
+
+	contains := func(list []string, s string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	result, err := deleteStory(DeleteStoryRequest{StoryID: id, RemoveWords: true, DryRun: true}, sqldb)
+	if err != nil {
+		t.Fatal("fail dry run delete: ", err)
+	}
+	if !contains(result.RemovedWords, "物語") || contains(result.RemovedWords, "船") || !contains(result.KeptWords, "読む") {
+		t.Errorf("unexpected dry run result: %+v", result)
+	}
+
+	var count int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM stories WHERE id = $1;`, id).Scan(&count)
+	if count != 1 {
+		t.Error("dry run should not delete the story")
+	}
+
+	_, err = deleteStory(DeleteStoryRequest{StoryID: id, RemoveWords: true}, sqldb)
+	if err != nil {
+		t.Fatal("fail delete: ", err)
+	}
+
+	sqldb.QueryRow(`SELECT COUNT(*) FROM stories WHERE id = $1;`, id).Scan(&count)
+	if count != 0 {
+		t.Error("story should be deleted")
+	}
+	sqldb.QueryRow(`SELECT COUNT(*) FROM words WHERE base_form IN ('物語', '船', '読む');`).Scan(&count)
+	if count != 2 {
+		t.Errorf("expected only the shared and drilled words to remain, found %d", count)
+	}
+}
+
+func TestTokenizeQueue(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	first, err := insertUntokenizedStory(Story{Title: "First", Link: "http://example.com/first", Content: "猫が走る"}, sqldb)
+	if err != nil {
+		t.Fatal("fail insert story: ", err)
+	}
+	second, err := insertUntokenizedStory(Story{Title: "Second", Link: "http://example.com/second", Content: "犬が寝る"}, sqldb)
+	if err != nil {
+		t.Fatal("fail insert story: ", err)
+	}
+	// deleted before its job runs, so the job fails
+	if _, err := sqldb.Exec(`DELETE FROM stories WHERE id = $1;`, second); err != nil {
+		t.Fatal("fail delete story: ", err)
+	}
+
+	// without a worker running, the jobs stay queued in order; a pending story isn't queued twice
+	enqueueTokenizeJob(TEST_DB_PATH, first)
+	enqueueTokenizeJob(TEST_DB_PATH, second)
+	enqueueTokenizeJob(TEST_DB_PATH, first)
+	if len(tokenizeQueue) != 2 {
+		t.Fatalf("expected two queued jobs, got %d", len(tokenizeQueue))
+	}
+	if job := nextTokenizeJob(); job.storyID != first {
+		t.Errorf("expected the first story's job first, got story %d", job.storyID)
+	}
+	if job := nextTokenizeJob(); job.storyID != second {
+		t.Errorf("expected the second story's job next, got story %d", job.storyID)
+	}
+
+	if err := tokenizeStory(TEST_DB_PATH, first); err != nil {
+		t.Fatal("fail tokenize story: ", err)
+	}
+	if _, ok := takeTokenizeStatus(TEST_DB_PATH, first); ok {
+		t.Error("expected a finished job's status to be dropped")
+	}
+
+	if err := tokenizeStory(TEST_DB_PATH, second); err == nil {
+		t.Error("expected the deleted story's job to fail")
+	}
+	status, ok := takeTokenizeStatus(TEST_DB_PATH, second)
+	if !ok || status.State != TOKENIZE_STATE_FAILED {
+		t.Errorf("expected the failed job's status, got %+v", status)
+	}
+	if _, ok := takeTokenizeStatus(TEST_DB_PATH, second); ok {
+		t.Error("expected a failed job's status to be dropped once read")
+	}
+}
+
+func TestTokenizeStoryRetry(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, err := insertUntokenizedStory(Story{Title: "Async", Link: "http://example.com/async",
+		Content: "0:01\n春のとても暖かい日でした\n0:04\nお母さんと2人の子供がいました"}, sqldb)
+	if err != nil {
+		t.Fatal("fail insert story: ", err)
+	}
+
+	story, err := getStory(id, sqldb)
+	if err != nil || story.IsTokenized || len(story.Lines) != 0 {
+		t.Fatalf("new story should not be tokenized yet: %+v (%v)", story, err)
+	}
+
+	_, err = insertUntokenizedStory(Story{Title: "Async", Content: "猫"}, sqldb)
+	if !errors.Is(err, errDuplicateTitle) {
+		t.Errorf("expected errDuplicateTitle for a second story titled Async, got %v", err)
+	}
+
+	if err := tokenizeStory(TEST_DB_PATH, id); err != nil {
+		t.Fatal("fail tokenize story: ", err)
+	}
+
+	var wordCount int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM words;`).Scan(&wordCount)
+
+	// simulate a job that crashed after inserting its words
+	if _, err := sqldb.Exec(`UPDATE stories SET is_tokenized = 0 WHERE id = $1;`, id); err != nil {
+		t.Fatal("fail reset story: ", err)
+	}
+	if err := tokenizeStory(TEST_DB_PATH, id); err != nil {
+		t.Fatal("fail retry tokenize story: ", err)
+	}
+
+	var retryWordCount int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM words;`).Scan(&retryWordCount)
+	if wordCount == 0 || wordCount != retryWordCount {
+		t.Errorf("retry should not add words: %d then %d", wordCount, retryWordCount)
+	}
+
+	story, err = getStory(id, sqldb)
+	if err != nil || !story.IsTokenized || len(story.Lines) != 2 || story.Lines[1].Timestamp != "0:04" {
+		t.Errorf("expected two tokenized lines: %+v (%v)", story, err)
+	}
+}
+
+func TestParagraphsAndSentences(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	punctuated := punctuateNewlines("春のとても暖かい日でした\nお母さんと、\n2人の子供がいました！\n「ちょっと待ってくれ」\n")
+	expected := "春のとても暖かい日でした。\nお母さんと、\n2人の子供がいました！\n「ちょっと待ってくれ」\n"
+	if punctuated != expected {
+		t.Errorf("unexpected punctuation: %q", punctuated)
+	}
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Paragraphs", Link: "http://example.com/paragraphs",
+		Content: "船が出ようとすると男の声が聞こえました\n本当？ 「ちょっと待ってくれ！」と言いました\n\nこれは次の段落です。"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	story, err := getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+
+	if len(story.Lines) != 2 {
+		t.Fatalf("expected two lines, got %d", len(story.Lines))
+	}
+
+	sentenceText := func(line Line, sentence LineSentence) string {
+		text := ""
+		for _, word := range line.Words[sentence.Start:sentence.End] {
+			text += word.Surface
+		}
+		return text
+	}
+
+	line := story.Lines[0]
+	if len(line.Paragraphs) != 2 {
+		t.Fatalf("expected two paragraphs in first line, got %v", line.Paragraphs)
+	}
+	if text := sentenceText(line, line.Paragraphs[0].Sentences[0]); text != "船が出ようとすると男の声が聞こえました。" {
+		t.Errorf("unexpected first sentence: %q", text)
+	}
+	sentences := line.Paragraphs[1].Sentences
+	if len(sentences) != 2 || sentenceText(line, sentences[0]) != "本当？" {
+		t.Fatalf("expected the second paragraph to split after ？, got %v", sentences)
+	}
+	if text := sentenceText(line, sentences[1]); text != "「ちょっと待ってくれ！」と言いました。" {
+		t.Errorf("quoted ！ should not end the sentence: %q", text)
+	}
+}
+
+func TestEditStoryPreservesLines(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Edit", Link: "http://example.com/edit",
+		Content: "0:01\n今日は晴れです\n0:05\n明日は雨が降ります\n0:09\n猫が寝ています"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	story, err := getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+	if len(story.Lines) != 3 {
+		t.Fatalf("expected three lines, got %d", len(story.Lines))
+	}
+
+	// mark the last line and manually split the second line after 明日は
+	story.Lines[2].Marked = true
+	first, second := splitLineAt(story.Lines[1], 2, "0:07")
+	story.Lines = []Line{story.Lines[0], first, second, story.Lines[2]}
+	linesBytes, _ := json.Marshal(story.Lines)
+	if _, err := sqldb.Exec(`UPDATE stories SET lines = $1 WHERE id = $2;`, linesBytes, id); err != nil {
+		t.Fatal("fail update lines: ", err)
+	}
+
+	title := "Edited"
+	content := "0:01\n今日は曇りです\n0:05\n明日は雨が降ります\n0:09\n猫が寝ています"
+	_, err = editStory(EditStoryRequest{StoryID: id, Title: &title, Content: &content}, sqldb)
+	if err != nil {
+		t.Fatal("fail edit story: ", err)
+	}
+
+	story, err = getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+	if story.Title != "Edited" {
+		t.Errorf("expected title to be edited, got %q", story.Title)
+	}
+	if len(story.Lines) != 4 {
+		t.Fatalf("expected the manual split to be kept, got %d lines", len(story.Lines))
+	}
+	if text := lineText(story.Lines[0]); text != "今日は曇りです" {
+		t.Errorf("expected edited first line, got %q", text)
+	}
+	if text := lineText(story.Lines[1]); text != "明日は" || story.Lines[2].Timestamp != "0:07" {
+		t.Errorf("expected split line to be re-split, got %q at %s", text, story.Lines[2].Timestamp)
+	}
+	if !story.Lines[3].Marked || story.Lines[3].Timestamp != "0:09" {
+		t.Errorf("expected unchanged line to stay marked")
+	}
+
+	// a failed edit saves none of its changes
+	if _, _, err := addStory(Story{Title: "Other", Link: "http://example.com/other", Content: "猫"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	newTitle, otherLink := "Renamed", "http://example.com/other"
+	if _, err = editStory(EditStoryRequest{StoryID: id, Title: &newTitle, Link: &otherLink}, sqldb); err == nil {
+		t.Fatal("expected a duplicate link to fail the edit")
+	}
+	if story, err = getStory(id, sqldb); err != nil || story.Title != title {
+		t.Errorf("expected the failed edit to keep the title %q, got %q (%v)", title, story.Title, err)
+	}
+
+	if _, err = editStory(EditStoryRequest{StoryID: id + 100, Title: &newTitle}, sqldb); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a missing story, got %v", err)
+	}
+}
+
+func TestParseSubtitles(t *testing.T) {
+	srt := "1\r\n00:00:01,500 --> 00:00:03,000\r\n<i>今日は</i>、\r\n\r\n" +
+		"2\r\n00:00:03,200 --> 00:00:05,000\r\nいい天気ですね。\r\n\r\n" +
+		"3\r\n01:02:03,040 --> 01:02:05,000\r\n{\\an8}そうですね\r\n\r\n" +
+		"4\r\n01:02:05,500 --> 01:02:08,000\r\n散歩に\r\n行きましょう\r\n"
+	cues, err := parseSubtitles(srt, "")
+	if err != nil {
+		t.Fatal("fail parse srt: ", err)
+	}
+	if len(cues) != 4 || cues[0].Text != "今日は、" || cues[2].Text != "そうですね" {
+		t.Fatalf("unexpected srt cues: %v", cues)
+	}
+	// the lines of a Japanese cue are joined without a space
+	if cues[3].Text != "散歩に行きましょう" {
+		t.Errorf("unexpected multi-line cue: %q", cues[3].Text)
+	}
+	if cues[2].Start != 3723.04 {
+		t.Errorf("expected hours and milliseconds to be parsed, got %v", cues[2].Start)
+	}
+
+	content := cuesToContent(mergeSubtitleCues(cues))
+	expected := "0:01.500\n今日は、いい天気ですね。\n62:03.040\nそうですね\n62:05.500\n散歩に行きましょう\n"
+	if content != expected {
+		t.Errorf("unexpected content: %q", content)
+	}
+
+	vtt := "WEBVTT\n\nNOTE a comment\n\nintro\n00:10.5 --> 00:12.000 align:start\n<c.yellow>猫が</c> &amp; 犬が\n"
+	cues, err = parseSubtitles(vtt, "")
+	if err != nil {
+		t.Fatal("fail parse vtt: ", err)
+	}
+	if len(cues) != 1 || cues[0].Text != "猫が & 犬が" || cues[0].Start != 10.5 {
+		t.Fatalf("unexpected vtt cues: %v", cues)
+	}
+
+	timestamps, lineContents := splitStoryContent(expected)
+	if len(timestamps) != 3 || len(lineContents) != 3 {
+		t.Errorf("imported content should split into timestamped lines, got %q", timestamps)
+	}
+}
+
+func TestExportStory(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Export", Link: "http://example.com/export",
+		Content: "0:02.500\n猫が食べた\n61:00\n<b>犬</b>です"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	story, err := getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+
+	srt, err := exportStorySubtitles(story, EXPORT_FORMAT_SRT)
+	if err != nil {
+		t.Fatal("fail export srt: ", err)
+	}
+	expected := "1\n00:00:02,500 --> 01:01:00,000\n猫が食べた\n\n" +
+		"2\n01:01:00,000 --> 01:01:05,000\n<b>犬</b>です\n\n"
+	if srt != expected {
+		t.Errorf("unexpected srt: %q", srt)
+	}
+
+	if ruby := rubyText("食べた", "たべた"); ruby != "<ruby>食<rt>た</rt></ruby>べた" {
+		t.Errorf("unexpected ruby: %q", ruby)
+	}
+
+	page := exportStoryHTML(story)
+	for _, expected := range []string{
+		`<span class="noun"><ruby>猫<rt>ねこ</rt></ruby></span>`,
+		"&lt;",
+		"<td>食べる</td><td>たべる</td><td>1</td>",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected html export to contain %q", expected)
+		}
+	}
+}
+
+func TestWordReviews(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	_, _, err = addStory(Story{Title: "Reviews", Link: "http://example.com/reviews", Content: "猫が寝ています"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	updates := []WordUpdate{
+		{BaseForm: "猫", Rank: 2, DateMarked: 100, Answer: REVIEW_ANSWER_CORRECT},
+		{BaseForm: "猫", Rank: 1, DateMarked: 200, Answer: REVIEW_ANSWER_WRONG},
+		{BaseForm: "猫", Rank: 3, DateMarked: 200}, // a rank change isn't a review
+		{BaseForm: "猫", Rank: 3, DateMarked: 300, Answer: REVIEW_ANSWER_CORRECT},
+	}
+	for _, update := range updates {
+		tx, err := sqldb.Begin()
+		if err != nil {
+			t.Fatal("fail begin: ", err)
+		}
+		if _, err := updateWord(update, tx); err != nil {
+			t.Fatal("fail update word: ", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal("fail commit: ", err)
+		}
+	}
+
+	history, err := getWordReviews("猫", 2, sqldb)
+	if err != nil {
+		t.Fatal("fail get reviews: ", err)
+	}
+	if history.DrillCount != 3 || history.Correct != 2 || history.Wrong != 1 {
+		t.Errorf("unexpected review counts: %+v", history)
+	}
+	if len(history.Reviews) != 2 || history.Reviews[0].Date != 300 || history.Reviews[0].OldRank != 3 {
+		t.Errorf("expected the two most recent reviews, got %+v", history.Reviews)
+	}
+	if history.Reviews[1].OldRank != 2 || history.Reviews[1].NewRank != 1 || history.Reviews[1].Correct {
+		t.Errorf("unexpected wrong review: %+v", history.Reviews[1])
+	}
+
+	if _, err := getWordReviews("存在しない", 0, sqldb); err != sql.ErrNoRows {
+		t.Errorf("expected missing word to return ErrNoRows, got %v", err)
+	}
+}
+
+func TestDrillWords(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Drill", Link: "http://example.com/drill", Content: "猫が走る"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	now := int64(1000000)
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 1, date_marked = $1;`, now); err != nil {
+		t.Fatal("fail mark words: ", err)
+	}
+	marks := map[string][2]int64{ // rank, date marked
+		"猫":  {1, now - DRILL_COOLDOWN_RANK_1 - 10}, // overdue by 10 seconds
+		"走る": {2, now - DRILL_COOLDOWN_RANK_2 - 1000},
+	}
+	for baseForm, mark := range marks {
+		if _, err := sqldb.Exec(`UPDATE words SET rank = $1, date_marked = $2 WHERE base_form = $3;`,
+			mark[0], mark[1], baseForm); err != nil {
+			t.Fatal("fail mark word: ", err)
+		}
+	}
+
+	drill, err := getDrillWords(DrillRequest{StoryIds: []int64{id}, Filter: DRILL_FILTER_OFF_COOLDOWN}, now, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 2 || drill.Words[0].BaseForm != "走る" || drill.Words[1].BaseForm != "猫" {
+		t.Fatalf("expected the longest overdue word first, got %+v", drill.Words)
+	}
+	if drill.OffCooldownCountsByRank[1] != 1 || drill.CountsByRank[1] != drill.Total-1 {
+		t.Errorf("unexpected counts: %+v", drill)
+	}
+
+	drill, err = getDrillWords(DrillRequest{StoryIds: []int64{id}, Filter: DRILL_FILTER_ON_COOLDOWN}, now, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 1 || drill.Words[0].BaseForm != "が" { // kanji are drilled apart from words
+		t.Errorf("expected only the particle on cooldown, got %+v", drill.Words)
+	}
+
+	drill, err = getDrillWords(DrillRequest{StoryIds: []int64{0}, MinRank: 2, Limit: 1}, now, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 1 || drill.Words[0].BaseForm != "走る" {
+		t.Errorf("expected rank and limit to apply, got %+v", drill.Words)
+	}
+}
+
+func TestSchedulers(t *testing.T) {
+	now := int64(1000000)
+
+	sm2 := SM2Scheduler{}
+	state := WordSchedule{}
+	for _, expected := range []float64{1, 6, 15} {
+		state = sm2.Review(state, true, now)
+		if state.Interval != expected {
+			t.Errorf("expected SM-2 interval %v, got %v", expected, state.Interval)
+		}
+		now = state.Due
+	}
+	state = sm2.Review(state, false, now)
+	if state.Interval != 1 || state.Repetitions != 0 || state.Ease >= SM2_INITIAL_EASE {
+		t.Errorf("expected a wrong answer to reset SM-2 and lower ease, got %+v", state)
+	}
+
+	fsrs := FSRSScheduler{}
+	state = WordSchedule{}
+	prevInterval := 0.0
+	for i := 0; i < 4; i++ {
+		state = fsrs.Review(state, true, now)
+		if state.Interval <= prevInterval {
+			t.Errorf("expected FSRS intervals to grow, got %v after %v", state.Interval, prevInterval)
+		}
+		prevInterval = state.Interval
+		now = state.Due
+	}
+	stability := state.Stability
+	state = fsrs.Review(state, false, now)
+	if state.Stability >= stability || state.Interval >= prevInterval {
+		t.Errorf("expected a lapse to shrink FSRS stability, got %+v", state)
+	}
+
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	if _, _, err = addStory(Story{Title: "Schedule", Link: "http://example.com/schedule", Content: "猫"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	if _, err := sqldb.Exec(`UPDATE settings SET scheduler = $1;`, SCHEDULER_SM2); err != nil {
+		t.Fatal("fail set scheduler: ", err)
+	}
+
+	now = 1000000
+	tx, err := sqldb.Begin()
+	if err != nil {
+		t.Fatal("fail begin: ", err)
+	}
+	if _, err := updateWord(WordUpdate{BaseForm: "猫", Rank: 1, DateMarked: now, Answer: REVIEW_ANSWER_CORRECT}, tx); err != nil {
+		t.Fatal("fail update word: ", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("fail commit: ", err)
+	}
+
+	// rank 1 is off cooldown after 5 hours, but SM-2 waits a day
+	later := now + DRILL_COOLDOWN_RANK_1 + 60
+	drill, err := getDrillWords(DrillRequest{Filter: DRILL_FILTER_ON_COOLDOWN}, later, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 1 || drill.Words[0].Due != now+SECONDS_PER_DAY {
+		t.Errorf("expected the SM-2 due date to apply, got %+v", drill.Words)
+	}
+
+	if _, err := sqldb.Exec(`UPDATE settings SET scheduler = $1;`, SCHEDULER_RANK); err != nil {
+		t.Fatal("fail set scheduler: ", err)
+	}
+	drill, err = getDrillWords(DrillRequest{Filter: DRILL_FILTER_OFF_COOLDOWN}, later, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 1 {
+		t.Errorf("expected the rank cooldown to apply after switching back, got %+v", drill.Words)
+	}
+}
+
+func TestDrillSettings(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	if _, _, err = addStory(Story{Title: "Settings", Link: "http://example.com/settings", Content: "猫が走る"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	settings, err := getSettings(sqldb)
+	if err != nil {
+		t.Fatal("fail get settings: ", err)
+	}
+	if settings.RankCount != DEFAULT_RANK_COUNT || settings.Cooldown(1) != DRILL_COOLDOWN_RANK_1 {
+		t.Fatalf("expected default settings, got %+v", settings)
+	}
+
+	settings, err = updateSettings(UserSettings{RankCount: 6}, sqldb)
+	if err != nil {
+		t.Fatal("fail update settings: ", err)
+	}
+	if len(settings.Cooldowns) != 6 || settings.Cooldown(6) != DRILL_COOLDOWN_RANK_4 {
+		t.Errorf("expected new ranks to get the default cooldowns, got %+v", settings)
+	}
+
+	now := int64(1000000)
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 6, date_marked = $1;`, now); err != nil {
+		t.Fatal("fail mark words: ", err)
+	}
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 1 WHERE base_form = '猫';`); err != nil {
+		t.Fatal("fail mark word: ", err)
+	}
+	if _, err := sqldb.Exec(`INSERT OR REPLACE INTO kanji (character, rank, date_marked, date_added, drill_count, encounter_count)
+		VALUES('走', 6, $1, 0, 0, 1);`, now); err != nil {
+		t.Fatal("fail mark kanji: ", err)
+	}
+
+	if _, err := updateSettings(UserSettings{Cooldowns: []int64{60}}, sqldb); !errors.Is(err, errInvalidSettings) {
+		t.Errorf("expected a cooldown per rank to be required, got %v", err)
+	}
+	if _, err := updateSettings(UserSettings{RankCount: SETTINGS_MAX_RANK_COUNT + 1}, sqldb); !errors.Is(err, errInvalidSettings) {
+		t.Errorf("expected too many ranks to be rejected, got %v", err)
+	}
+
+	settings, err = updateSettings(UserSettings{RankCount: 3, Cooldowns: []int64{60, 120, 180}}, sqldb)
+	if err != nil {
+		t.Fatal("fail update settings: ", err)
+	}
+
+	var maxRank int
+	if err := sqldb.QueryRow(`SELECT MAX(rank) FROM words;`).Scan(&maxRank); err != nil {
+		t.Fatal("fail get max rank: ", err)
+	}
+	if maxRank != 3 {
+		t.Errorf("expected words above the new top rank to move down to it, got max rank %d", maxRank)
+	}
+	if err := sqldb.QueryRow(`SELECT MAX(rank) FROM kanji;`).Scan(&maxRank); err != nil {
+		t.Fatal("fail get max kanji rank: ", err)
+	}
+	if maxRank != 3 {
+		t.Errorf("expected kanji above the new top rank to move down to it, got max rank %d", maxRank)
+	}
+
+	drill, err := getDrillWords(DrillRequest{Filter: DRILL_FILTER_OFF_COOLDOWN}, now+90, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	if len(drill.Words) != 1 || drill.Words[0].BaseForm != "猫" || len(drill.CountsByRank) != 4 {
+		t.Errorf("expected only the rank 1 word off cooldown, got %+v", drill)
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		t.Fatal("fail begin: ", err)
+	}
+	defer tx.Rollback()
+	if _, err := updateWord(WordUpdate{BaseForm: "猫", Rank: 4, DateMarked: now}, tx); !errors.Is(err, errInvalidRank) {
+		t.Errorf("expected a rank above the rank count to be rejected, got %v", err)
+	}
+}
+
+func TestKanji(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	keepID, _, err := addStory(Story{Title: "Time", Link: "http://example.com/time", Content: "時間がない"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	id, _, err := addStory(Story{Title: "Gap", Link: "http://example.com/gap", Content: "間に合う"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	var count int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM words WHERE category & $1 != 0;`, DRILL_CATEGORY_KANJI).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no kanji in the words table, found %d", count)
+	}
+
+	drill, err := getDrillKanji(DrillRequest{StoryIds: []int64{keepID}}, 1000000, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill kanji: ", err)
+	}
+	if len(drill.Kanji) != 2 || drill.Total != 2 {
+		t.Fatalf("expected the story's two kanji, got %+v", drill)
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		t.Fatal("fail begin: ", err)
+	}
+	if _, err := updateWord(WordUpdate{BaseForm: "時間", Rank: 1, DateMarked: 1000000, Answer: REVIEW_ANSWER_CORRECT}, tx); err != nil {
+		t.Fatal("fail update word: ", err)
+	}
+	kanji, err := updateKanji(KanjiUpdate{Character: "時", Rank: 2, DateMarked: 1000000, Answer: REVIEW_ANSWER_WRONG}, tx)
+	if err != nil {
+		t.Fatal("fail update kanji: ", err)
+	}
+	if kanji.DrillCount != 1 || kanji.EncounterCount != 1 {
+		t.Errorf("expected one drill and one encounter of 時, got %+v", kanji)
+	}
+	if _, err := updateKanji(KanjiUpdate{Character: "猫", Rank: 1}, tx); err != sql.ErrNoRows {
+		t.Errorf("expected a missing kanji to be reported, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("fail commit: ", err)
+	}
+
+	var encounters int
+	sqldb.QueryRow(`SELECT encounter_count FROM kanji WHERE character = '間';`).Scan(&encounters)
+	if encounters != 1 {
+		t.Errorf("expected drilling 時間 to count an encounter of 間, got %d", encounters)
+	}
+
+	result, err := deleteStory(DeleteStoryRequest{StoryID: id, RemoveWords: true}, sqldb)
+	if err != nil {
+		t.Fatal("fail delete: ", err)
+	}
+	if len(result.RemovedKanji) != 1 || result.RemovedKanji[0] != "合" || len(result.KeptKanji) != 0 {
+		t.Errorf("expected only the kanji unique to the story to be removed, got %+v", result)
+	}
+	sqldb.QueryRow(`SELECT COUNT(*) FROM story_kanji WHERE story = $1;`, id).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected the story's kanji list to be removed, found %d", count)
+	}
+}
+
+func TestEditLegacyStory(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Legacy", Link: "http://example.com/legacy",
+		Content: "0:01\n今日は晴れです\n明日は雨が降ります\n0:09\n猫が寝ています"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	story, err := getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+
+	// a line tokenized before punctuateNewlines, without the 。 inserted at its newline; the
+	// user split it after 今日は晴れです and marked it
+	words := make([]LineWord, 0)
+	for _, word := range story.Lines[0].Words {
+		if word.Surface != "。" {
+			words = append(words, word)
+		}
+	}
+	story.Lines[0].Words = words
+	story.Lines[0].Marked = true
+	first, second := splitLineAt(story.Lines[0], 4, "0:05")
+	story.Lines = []Line{first, second, story.Lines[1]}
+	linesBytes, _ := json.Marshal(story.Lines)
+	if _, err := sqldb.Exec(`UPDATE stories SET lines = $1 WHERE id = $2;`, linesBytes, id); err != nil {
+		t.Fatal("fail update lines: ", err)
+	}
+
+	content := "0:01\n今日は晴れです\n明日は雨が降ります\n0:09\n猫が寝ていました"
+	if _, err = editStory(EditStoryRequest{StoryID: id, Content: &content}, sqldb); err != nil {
+		t.Fatal("fail edit story: ", err)
+	}
+
+	story, err = getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+	if len(story.Lines) != 3 {
+		t.Fatalf("expected the manual split to be kept, got %d lines", len(story.Lines))
+	}
+	if text := lineText(story.Lines[0]); text != "今日は晴れです" || !story.Lines[0].Marked {
+		t.Errorf("expected the marked split line to be kept, got %q", text)
+	}
+	if last := story.Lines[0].Words[len(story.Lines[0].Words)-1]; last.Surface != "。" {
+		t.Errorf("expected the inserted 。 to end the split line, got %q", last.Surface)
+	}
+	if story.Lines[1].Timestamp != "0:05" {
+		t.Errorf("expected the split's timestamp to be kept, got %s", story.Lines[1].Timestamp)
+	}
+}
+
+func TestMigrateKanji(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	// a story from before kanji had their own table, with the kanji stored as words
+	result, err := sqldb.Exec(`INSERT INTO words (base_form, date_marked, date_added, category, rank, drill_count)
+		VALUES('間', 1000, 0, $1, 3, 7);`, DRILL_CATEGORY_KANJI)
+	if err != nil {
+		t.Fatal("fail insert kanji word: ", err)
+	}
+	wordID, _ := result.LastInsertId()
+	lines, _ := json.Marshal([]Line{{Timestamp: "0:00", Kanji: []LineKanji{{ID: wordID, Character: "間"}}}})
+	result, err = sqldb.Exec(`INSERT INTO stories (lines, title, link, date_added, status, audio, countdown, read_count, date_last_read)
+		VALUES($1, 'Old', 'http://example.com/old', 0, 0, '', 0, 0, 0);`, lines)
+	if err != nil {
+		t.Fatal("fail insert story: ", err)
+	}
+	storyID, _ := result.LastInsertId()
+
+	// the kanji table already exists, as after a migration which failed, so the migration is
+	// retried while words are still kanji
+	if pending, err := kanjiMigrationPending(sqldb); err != nil || !pending {
+		t.Fatal("expected the kanji migration to be pending: ", err)
+	}
+	if err := makeUserDB(USERHASH); err != nil {
+		t.Fatal("fail make user db: ", err)
+	}
+	if pending, err := kanjiMigrationPending(sqldb); err != nil || pending {
+		t.Error("expected the kanji migration to be done: ", err)
+	}
+
+	var count int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM words;`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected the kanji to be removed from the words table, found %d words", count)
+	}
+
+	var kanjiID int64
+	var rank, drillCount int
+	row := sqldb.QueryRow(`SELECT id, rank, drill_count FROM kanji WHERE character = '間';`)
+	if err := row.Scan(&kanjiID, &rank, &drillCount); err != nil {
+		t.Fatal("fail get migrated kanji: ", err)
+	}
+	if rank != 3 || drillCount != 7 {
+		t.Errorf("expected the kanji's rank and drill count to carry over, got %d and %d", rank, drillCount)
+	}
+
+	story, err := getStory(storyID, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+	if story.Lines[0].Kanji[0].ID != kanjiID {
+		t.Errorf("expected the line's kanji to refer to the kanji table, got %+v", story.Lines[0].Kanji)
+	}
+	sqldb.QueryRow(`SELECT COUNT(*) FROM story_kanji WHERE story = $1 AND kanji = $2;`, storyID, kanjiID).Scan(&count)
+	if count != 1 {
+		t.Error("expected the story's kanji list to be backfilled")
+	}
+}
+
+func TestMigrateKanjiKeepsWords(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	// 家 was drilled both as a kanji and as a word of the story, sharing one row
+	result, err := sqldb.Exec(`INSERT INTO words (base_form, date_marked, date_added, category, rank, drill_count)
+		VALUES('家', 1000, 0, $1, 3, 7);`, DRILL_CATEGORY_KANJI)
+	if err != nil {
+		t.Fatal("fail insert kanji word: ", err)
+	}
+	wordID, _ := result.LastInsertId()
+	if _, err := sqldb.Exec(`INSERT INTO reviews (word, date, correct, old_rank, new_rank) VALUES($1, 1000, 1, 2, 3);`, wordID); err != nil {
+		t.Fatal("fail insert review: ", err)
+	}
+	if _, err := sqldb.Exec(`INSERT INTO word_schedules (word, scheduler) VALUES($1, 'sm2');`, wordID); err != nil {
+		t.Fatal("fail insert word schedule: ", err)
+	}
+	lines, _ := json.Marshal([]Line{{
+		Timestamp: "0:00",
+		Words:     []LineWord{{ID: wordID, BaseForm: "家", Surface: "家"}},
+		Kanji:     []LineKanji{{ID: wordID, Character: "家"}},
+	}})
+	if _, err := sqldb.Exec(`INSERT INTO stories (lines, title, link, date_added, status, audio, countdown, read_count, date_last_read)
+		VALUES($1, 'Old', 'http://example.com/old', 0, 0, '', 0, 0, 0);`, lines); err != nil {
+		t.Fatal("fail insert story: ", err)
+	}
+
+	if err := migrateKanji(sqldb); err != nil {
+		t.Fatal("fail migrate kanji: ", err)
+	}
+
+	var category, rank int
+	row := sqldb.QueryRow(`SELECT category, rank FROM words WHERE id = $1;`, wordID)
+	if err := row.Scan(&category, &rank); err != nil {
+		t.Fatal("expected the word to be kept: ", err)
+	}
+	if category&DRILL_CATEGORY_KANJI != 0 || rank != 3 {
+		t.Errorf("expected the word to keep its rank without the kanji category, got category %d, rank %d", category, rank)
+	}
+	var count int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM reviews WHERE word = $1;`, wordID).Scan(&count)
+	if count != 1 {
+		t.Error("expected the word's reviews to be kept")
+	}
+	sqldb.QueryRow(`SELECT COUNT(*) FROM word_schedules WHERE word = $1;`, wordID).Scan(&count)
+	if count != 1 {
+		t.Error("expected the word's schedule to be kept")
+	}
+	sqldb.QueryRow(`SELECT COUNT(*) FROM kanji WHERE character = '家' AND rank = 3;`).Scan(&count)
+	if count != 1 {
+		t.Error("expected the kanji to be copied to the kanji table")
+	}
+}
+
+func TestDrillStats(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	if _, _, err = addStory(Story{Title: "Stats", Link: "http://example.com/stats", Content: "猫が走る"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	now := time.Now().Unix()
+	lastWeek := now - SECONDS_PER_WEEK
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 1, date_marked = $1;`, now); err != nil {
+		t.Fatal("fail mark words: ", err)
+	}
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 2, date_marked = $1, date_added = $2 WHERE base_form = '走る';`,
+		now-DRILL_COOLDOWN_RANK_2-1, lastWeek); err != nil {
+		t.Fatal("fail mark word: ", err)
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		t.Fatal("fail begin: ", err)
+	}
+	for _, answer := range []string{REVIEW_ANSWER_CORRECT, REVIEW_ANSWER_WRONG} {
+		if _, err := updateWord(WordUpdate{BaseForm: "猫", Rank: 1, DateMarked: now, Answer: answer}, tx); err != nil {
+			t.Fatal("fail update word: ", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("fail commit: ", err)
+	}
+
+	stats, err := getDrillStats(now, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill stats: ", err)
+	}
+	if stats.CountsByRank[1] != stats.TotalWords-1 || stats.CountsByRank[2] != 1 || stats.CountsByCategory["kanji"] != 2 {
+		t.Errorf("unexpected counts: %+v", stats)
+	}
+	if stats.Overdue != 1 || stats.DueForecast[0] != stats.TotalWords-1 {
+		t.Errorf("expected the rank 2 word overdue and the rest due within a day, got %+v", stats)
+	}
+	if len(stats.WordsAddedByWeek) < 2 || stats.WordsAddedByWeek[len(stats.WordsAddedByWeek)-1].Count != stats.TotalWords-1 {
+		t.Errorf("unexpected words added by week: %+v", stats.WordsAddedByWeek)
+	}
+	if len(stats.AccuracyByRank) != 1 || stats.AccuracyByRank[0].Total != 2 || stats.AccuracyByRank[0].Accuracy != 0.5 {
+		t.Errorf("unexpected accuracy by rank: %+v", stats.AccuracyByRank)
+	}
+}
+
+func TestClozes(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Cat", Link: "http://example.com/cat", Content: "猫が走る。犬が寝る。"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	if _, _, err = addStory(Story{Title: "Cats", Link: "http://example.com/cats", Content: "猫と猫が遊ぶ。"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	now := int64(1000000)
+	if _, err := sqldb.Exec(`UPDATE words SET rank = 1, date_marked = $1;`, now); err != nil {
+		t.Fatal("fail mark words: ", err)
+	}
+	if _, err := sqldb.Exec(`UPDATE words SET date_marked = 0 WHERE base_form = '猫';`); err != nil {
+		t.Fatal("fail mark word: ", err)
+	}
+
+	// the word is chosen from the first story, but its sentences come from both
+	clozes, err := getClozes(ClozeRequest{StoryIds: []int64{id}}, now, sqldb)
+	if err != nil {
+		t.Fatal("fail get clozes: ", err)
+	}
+	if len(clozes) != 1 || clozes[0].Word.BaseForm != "猫" || len(clozes[0].Contexts) != 2 {
+		t.Fatalf("expected the due word with a sentence from each story, got %+v", clozes)
+	}
+
+	for _, context := range clozes[0].Contexts {
+		if strings.Contains(context.Sentence, "猫") || !strings.Contains(context.Sentence, CLOZE_BLANK) {
+			t.Errorf("expected the word to be blanked out, got %q", context.Sentence)
+		}
+		if context.StoryTitle == "Cat" && (context.Sentence != CLOZE_BLANK+"が走る。" || len(context.Answers) != 1) {
+			t.Errorf("expected only the word's own sentence, got %+v", context)
+		}
+		if context.StoryTitle == "Cats" && len(context.Answers) != 2 {
+			t.Errorf("expected both occurrences to be blanked, got %+v", context)
+		}
+	}
+
+	clozes, err = getClozes(ClozeRequest{StoryIds: []int64{id}, MaxContexts: 1}, now, sqldb)
+	if err != nil {
+		t.Fatal("fail get clozes: ", err)
+	}
+	if len(clozes) != 1 || len(clozes[0].Contexts) != 1 || clozes[0].Contexts[0].StoryTitle != "Cats" {
+		t.Errorf("expected one sentence from the newest story, got %+v", clozes)
+	}
+}
+
+func TestUpdateWords(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	if _, _, err = addStory(Story{Title: "Batch", Link: "http://example.com/batch", Content: "猫が走る"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	now := int64(1000000)
+	result, err := updateWords([]WordUpdate{
+		{BaseForm: "猫", Rank: 2, DateMarked: now, Answer: REVIEW_ANSWER_CORRECT},
+		{BaseForm: "犬", Rank: 2, DateMarked: now},
+		{BaseForm: "走る", Rank: 3, DateMarked: now, Answer: "maybe"},
+		{BaseForm: "走る", Rank: 2, DateMarked: now, Answer: REVIEW_ANSWER_WRONG},
+	}, sqldb)
+	if err != nil {
+		t.Fatal("fail update words: ", err)
+	}
+	if result.Updated != 2 || result.Failed != 2 {
+		t.Fatalf("expected two updates to succeed and two to fail, got %+v", result)
+	}
+	if result.Results[1].Error != "word not found" || !strings.Contains(result.Results[2].Error, "invalid answer") {
+		t.Errorf("expected per-item errors, got %+v", result.Results)
+	}
+	if result.Results[0].Word == nil || result.Results[0].Word.DrillCount != 1 {
+		t.Errorf("expected the updated word in the result, got %+v", result.Results[0])
+	}
+
+	var rank, drillCount int
+	sqldb.QueryRow(`SELECT rank, drill_count FROM words WHERE base_form = '走る';`).Scan(&rank, &drillCount)
+	if rank != 2 || drillCount != 1 {
+		t.Errorf("expected only the valid update of 走る to apply, got rank %d and drill count %d", rank, drillCount)
+	}
+	var reviews int
+	sqldb.QueryRow(`SELECT COUNT(*) FROM reviews;`).Scan(&reviews)
+	if reviews != 2 {
+		t.Errorf("expected a review for each valid answer, got %d", reviews)
+	}
+}
+
+func TestLeeches(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	if _, _, err = addStory(Story{Title: "Leech", Link: "http://example.com/leech", Content: "猫が走る"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	suspendLeeches := true
+	if _, err := updateSettings(UserSettings{LeechThreshold: 2, SuspendLeeches: &suspendLeeches}, sqldb); err != nil {
+		t.Fatal("fail update settings: ", err)
+	}
+
+	answers := []string{REVIEW_ANSWER_CORRECT, REVIEW_ANSWER_WRONG, REVIEW_ANSWER_WRONG, REVIEW_ANSWER_CORRECT, REVIEW_ANSWER_WRONG}
+	expectedLapses := []int{0, 1, 1, 1, 2}
+	for i, answer := range answers {
+		tx, err := sqldb.Begin()
+		if err != nil {
+			t.Fatal("fail begin: ", err)
+		}
+		word, err := updateWord(WordUpdate{BaseForm: "猫", Rank: 1, DateMarked: int64(1000000 + i), Answer: answer}, tx)
+		if err != nil {
+			t.Fatal("fail update word: ", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal("fail commit: ", err)
+		}
+		if word.Lapses != expectedLapses[i] {
+			t.Errorf("answer %d: expected %d lapses, got %d", i, expectedLapses[i], word.Lapses)
+		}
+		if last := i == len(answers)-1; word.Leech != last || word.Suspended != last {
+			t.Errorf("answer %d: expected the word to become a suspended leech only at the threshold, got %+v", i, word)
+		}
+	}
+
+	leeches, err := getLeeches(sqldb)
+	if err != nil {
+		t.Fatal("fail get leeches: ", err)
+	}
+	if len(leeches) != 1 || leeches[0].BaseForm != "猫" || leeches[0].Lapses != 2 || leeches[0].Accuracy != 0.4 {
+		t.Errorf("unexpected leeches: %+v", leeches)
+	}
+
+	drill, err := getDrillWords(DrillRequest{}, 2000000, sqldb)
+	if err != nil {
+		t.Fatal("fail get drill words: ", err)
+	}
+	for _, word := range drill.Words {
+		if word.BaseForm == "猫" {
+			t.Error("expected the suspended leech to be left out of drills")
+		}
+	}
+
+	if err := updateLeech(LeechUpdate{BaseForm: "猫", Suspended: false, ClearLeech: true}, sqldb); err != nil {
+		t.Fatal("fail update leech: ", err)
+	}
+	leeches, err = getLeeches(sqldb)
+	if err != nil {
+		t.Fatal("fail get leeches: ", err)
+	}
+	if len(leeches) != 0 {
+		t.Errorf("expected the cleared leech to be unlisted, got %+v", leeches)
+	}
+	if err := updateLeech(LeechUpdate{BaseForm: "犬", Suspended: true}, sqldb); err != sql.ErrNoRows {
+		t.Errorf("expected a missing word to be reported, got %v", err)
+	}
+}
+
+func TestWordNotes(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	id, _, err := addStory(Story{Title: "Notes", Link: "http://example.com/notes", Content: "上手が走る"}, sqldb, false)
+	if err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+
+	// homographs, as getDefinitions would return them from the dictionary; the last two share
+	// their spelling and reading
+	skilful := JMDictEntry{Ent_seq: "1", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "上手"}}, Readings: []JMDictR_ele{{Reading: "じょうず"}}}
+	upper := JMDictEntry{Ent_seq: "2", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "上手"}}, Readings: []JMDictR_ele{{Reading: "かみて"}}}
+	upstream := JMDictEntry{Ent_seq: "3", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "上手"}}, Readings: []JMDictR_ele{{Reading: "かみて"}}}
+	definitionsCache["上手"] = []JMDictEntry{skilful, upper, upstream}
+
+	err = updateWordNote(WordNote{BaseForm: "上手", PrimaryEntry: "4"}, sqldb)
+	if !errors.Is(err, errInvalidEntry) {
+		t.Errorf("expected an entry not in the dictionary to be rejected, got %v", err)
+	}
+	if err := updateWordNote(WordNote{BaseForm: "犬", Note: "dog"}, sqldb); err != sql.ErrNoRows {
+		t.Errorf("expected a missing word to be reported, got %v", err)
+	}
+
+	note := WordNote{BaseForm: "上手", Note: "stage left", Mnemonic: "the upper hand", Gloss: "upstage", PrimaryEntry: entryKey(upstream)}
+	if err := updateWordNote(note, sqldb); err != nil {
+		t.Fatal("fail update word note: ", err)
+	}
+
+	story, err := getStory(id, sqldb)
+	if err != nil {
+		t.Fatal("fail get story: ", err)
+	}
+	info := story.WordInfo["上手"]
+	if info.Note != note.Note || info.Mnemonic != note.Mnemonic || info.Gloss != note.Gloss || info.PrimaryEntry != "3" {
+		t.Errorf("expected the notes in the story's word info, got %+v", info)
+	}
+	if len(info.Definitions) != 3 || entryKey(info.Definitions[0]) != note.PrimaryEntry {
+		t.Errorf("expected the primary entry first, got %+v", info.Definitions)
+	}
+	if entryKey(definitionsCache["上手"][0]) != entryKey(skilful) {
+		t.Error("expected the cached definitions to keep their order")
+	}
+
+	if err := updateWordNote(WordNote{BaseForm: "上手"}, sqldb); err != nil {
+		t.Fatal("fail clear word note: ", err)
+	}
+	notes, err := getWordNotes(sqldb)
+	if err != nil {
+		t.Fatal("fail get word notes: ", err)
+	}
+	if len(notes) != 0 {
+		t.Errorf("expected clearing every field to remove the note, got %+v", notes)
+	}
+}
+
+func TestCommonness(t *testing.T) {
+	if score := priorityScore([]string{"news1", "ichi1", "nf01"}); score != 2*PRIORITY_SCORE_1+PRIORITY_NF_BUCKETS {
+		t.Errorf("expected news1, ichi1 and nf01 to score %d, got %d", 2*PRIORITY_SCORE_1+PRIORITY_NF_BUCKETS, score)
+	}
+	if score := priorityScore([]string{"spec2", "nf48", "nf99"}); score != PRIORITY_SCORE_2+1 {
+		t.Errorf("expected spec2 and nf48 to score %d, got %d", PRIORITY_SCORE_2+1, score)
+	}
+
+	obscure := JMDictEntry{
+		KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "食み"}},
+		Readings:       []JMDictR_ele{{Reading: "はみ"}},
+	}
+	common := JMDictEntry{
+		KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "食べる", Ke_pri: []string{"ichi1", "news1", "nf25"}}},
+		Readings:       []JMDictR_ele{{Reading: "たべる", Re_pri: []string{"ichi1"}}},
+	}
+	exact := JMDictEntry{
+		KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "食"}},
+		Readings:       []JMDictR_ele{{Reading: "しょく"}},
+	}
+	for _, entry := range []*JMDictEntry{&obscure, &common, &exact} {
+		entry.Commonness = entryCommonness(*entry)
+	}
+	if obscure.Commonness != 0 || common.Commonness != 2*PRIORITY_SCORE_1+24 {
+		t.Errorf("expected commonness 0 and %d, got %d and %d", 2*PRIORITY_SCORE_1+24, obscure.Commonness, common.Commonness)
+	}
+
+	entries := []*JMDictEntry{&obscure, &common, &exact}
+	sortResults(entries, true, "食")
+	if entries[0].KanjiSpellings[0].KanjiSpelling != "食" || entries[1].KanjiSpellings[0].KanjiSpelling != "食べる" {
+		t.Errorf("expected the exact match then the common word first, got %+v", entries)
+	}
+
+	if allEntriesByKanjiSpellings == nil {
+		allEntriesByKanjiSpellings = make(map[string][]*JMDictEntry)
+	}
+	second := common
+	second.Ent_seq = "2"
+	allEntriesByKanjiSpellings["食べる"] = []*JMDictEntry{&obscure, &second}
+	defer delete(allEntriesByKanjiSpellings, "食べる")
+	defer delete(definitionsCache, "食べる")
+	definitions := getDefinitions("食べる")
+	if len(definitions) != 2 || definitions[0].Ent_seq != "2" {
+		t.Errorf("expected the common entry first, got %+v", definitions)
+	}
+}
+
+func TestWordSearch(t *testing.T) {
+	entries := []JMDictEntry{
+		{Ent_seq: "1", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "日本"}}, Readings: []JMDictR_ele{{Reading: "にほん"}}},
+		{Ent_seq: "2", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "日本語"}, {KanjiSpelling: "本日本"}}, Readings: []JMDictR_ele{{Reading: "にほんご"}}},
+		{Ent_seq: "3", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "本日"}}, Readings: []JMDictR_ele{{Reading: "ほんじつ"}}},
+		{Ent_seq: "4", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "絵本"}}, Readings: []JMDictR_ele{{Reading: "えほん"}},
+			Commonness: PRIORITY_SCORE_1},
+		{Ent_seq: "5", KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "見本"}}, Readings: []JMDictR_ele{{Reading: "みほん"}}},
+	}
+
+	oldByKanjiSpellings, oldByReading := allEntriesByKanjiSpellings, allEntriesByReading
+	defer func() {
+		allEntriesByKanjiSpellings, allEntriesByReading = oldByKanjiSpellings, oldByReading
+		buildSearchIndexes()
+	}()
+	allEntriesByKanjiSpellings = make(map[string][]*JMDictEntry)
+	allEntriesByReading = make(map[string][]*JMDictEntry)
+	for i := range entries {
+		for _, k_ele := range entries[i].KanjiSpellings {
+			allEntriesByKanjiSpellings[k_ele.KanjiSpelling] = append(allEntriesByKanjiSpellings[k_ele.KanjiSpelling], &entries[i])
+		}
+		for _, r_ele := range entries[i].Readings {
+			allEntriesByReading[r_ele.Reading] = append(allEntriesByReading[r_ele.Reading], &entries[i])
+		}
+	}
+	buildSearchIndexes()
+
+	sequences := func(entries []JMDictEntry) string {
+		seqs := make([]string, 0)
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Ent_seq)
+		}
+		return strings.Join(seqs, ",")
+	}
+
+	// 日本語 also contains 本 elsewhere, but starts with 本 in its other spelling
+	result := searchEntries("本", 0, 10)
+	if result.CountStart != 2 || sequences(result.EntriesStart) != "3,2" {
+		t.Errorf("expected start matches 3,2, got %s of %d", sequences(result.EntriesStart), result.CountStart)
+	}
+	if result.CountMid != 3 || sequences(result.EntriesMid) != "4,1,5" {
+		t.Errorf("expected mid matches 4,1,5 (the common word first), got %s of %d", sequences(result.EntriesMid), result.CountMid)
+	}
+	if result.EntriesMid[1].ShortestKanjiSpelling != 2 || entries[0].ShortestKanjiSpelling != 0 {
+		t.Errorf("expected the shortest spelling set on the result, not the shared entry, got %d and %d",
+			result.EntriesMid[1].ShortestKanjiSpelling, entries[0].ShortestKanjiSpelling)
+	}
+
+	// a page spanning the start and mid matches
+	result = searchEntries("本", 1, 2)
+	if sequences(result.EntriesStart) != "2" || sequences(result.EntriesMid) != "4" || result.CountStart != 2 || result.CountMid != 3 {
+		t.Errorf("expected the page 2 then 4, got %s then %s", sequences(result.EntriesStart), sequences(result.EntriesMid))
+	}
+	result = searchEntries("本", 4, 10)
+	if len(result.EntriesStart) != 0 || sequences(result.EntriesMid) != "5" {
+		t.Errorf("expected the last page to be 5, got %s then %s", sequences(result.EntriesStart), sequences(result.EntriesMid))
+	}
+
+	result = searchEntries("にほん", 0, 10)
+	if sequences(result.EntriesStart) != "1,2" || sequences(result.EntriesMid) != "" {
+		t.Errorf("expected reading matches 1,2, got %s then %s", sequences(result.EntriesStart), sequences(result.EntriesMid))
+	}
+
+	// regex metacharacters are matched literally
+	for _, word := range []string{"(", "*", "本(", ""} {
+		result = searchEntries(word, 0, 10)
+		if result.CountStart != 0 || result.CountMid != 0 {
+			t.Errorf("expected no matches for %q, got %+v", word, result)
+		}
+	}
+}
+
+func TestGlossSearch(t *testing.T) {
+	setup(t)
+	defer teardown(t)
+
+	sqldb, err := sql.Open("sqlite3", TEST_DB_PATH)
+	if err != nil {
+		t.Fatal("could not setup database")
+	}
+	defer sqldb.Close()
+
+	stems := map[string]string{"cities": "city", "boxes": "box", "making": "mak", "make": "mak",
+		"running": "run", "calling": "call", "seeing": "see", "houses": "hous", "classes": "class", "bus": "bus"}
+	for word, expected := range stems {
+		if stem(word) != expected {
+			t.Errorf("expected %s to stem to %s, got %s", word, expected, stem(word))
+		}
+	}
+
+	entry := func(kanji string, reading string, commonness int, glosses ...string) JMDictEntry {
+		sense := JMDictSense{}
+		for _, gloss := range glosses {
+			sense.Gloss = append(sense.Gloss, JMDictGloss{Value: gloss})
+		}
+		return JMDictEntry{
+			KanjiSpellings: []JMDictK_ele{{KanjiSpelling: kanji}},
+			Readings:       []JMDictR_ele{{Reading: reading}},
+			Senses:         []JMDictSense{sense},
+			Commonness:     commonness,
+		}
+	}
+
+	oldEntries, oldGlossIndex := allEntries, glossIndex
+	defer func() {
+		allEntries, glossIndex = oldEntries, oldGlossIndex
+	}()
+	allEntries = JMDict{Entries: []JMDictEntry{
+		entry("子猫", "こねこ", 0, "kitten", "young cat"),
+		entry("猫舌", "ねこじた", 0, "cat's tongue", "aversion to hot food"),
+		entry("猫", "ねこ", PRIORITY_SCORE_1, "Cat"),
+		entry("走り回る", "はしりまわる", 0, "to run around"),
+		entry("走る", "はしる", 0, "to run"),
+		entry("駆ける", "かける", PRIORITY_SCORE_1, "to run (like a horse)", "to run"),
+	}}
+	buildGlossIndex()
+
+	kanji := func(matches []GlossMatch) string {
+		words := make([]string, 0)
+		for _, match := range matches {
+			words = append(words, match.Entry.KanjiSpellings[0].KanjiSpelling+":"+match.Match)
+		}
+		return strings.Join(words, ",")
+	}
+
+	result := searchGlosses("CATS", 0, 10)
+	if result.Count != 3 || kanji(result.Matches) != "猫:whole,猫舌:start,子猫:inside" {
+		t.Errorf("expected whole, start then inside matches, got %s of %d", kanji(result.Matches), result.Count)
+	}
+
+	// the common word first among the whole matches
+	result = searchGlosses("running", 0, 10)
+	if kanji(result.Matches) != "駆ける:whole,走る:whole,走り回る:start" {
+		t.Errorf("expected the run matches by commonness, got %s", kanji(result.Matches))
+	}
+	if result.Matches[0].Gloss != "to run" {
+		t.Errorf("expected the best gloss of 駆ける to be the whole match, got %s", result.Matches[0].Gloss)
+	}
+
+	result = searchGlosses("to run around", 0, 10)
+	if kanji(result.Matches) != "走り回る:whole" {
+		t.Errorf("expected a multiword whole match, got %s", kanji(result.Matches))
+	}
+
+	result = searchGlosses("running", 1, 1)
+	if result.Count != 3 || kanji(result.Matches) != "走る:whole" {
+		t.Errorf("expected the second page of one, got %s of %d", kanji(result.Matches), result.Count)
+	}
+
+	if result = searchGlosses("dog", 0, 10); result.Count != 0 {
+		t.Errorf("expected no matches for dog, got %d", result.Count)
+	}
+
+	if _, _, err = addStory(Story{Title: "Cat", Link: "http://example.com/cat", Content: "猫が走る"}, sqldb, false); err != nil {
+		t.Fatal("fail add story: ", err)
+	}
+	result = searchGlosses("cat", 0, 10)
+	if err := flagKnownWords(result.Matches, sqldb); err != nil {
+		t.Fatal("fail flag known words: ", err)
+	}
+	if result.Matches[0].KnownWord != "猫" || result.Matches[0].Rank != INITIAL_RANK || result.Matches[1].KnownWord != "" {
+		t.Errorf("expected only 猫 to be known, got %+v", result.Matches)
+	}
+
+	// a known kana word doesn't make its kanji homophones known
+	if _, err := sqldb.Exec(`INSERT INTO words (base_form, drill_count, category, date_marked, date_added, rank)
+		VALUES('かみ', 0, 0, 0, 0, 2);`); err != nil {
+		t.Fatal("fail insert word: ", err)
+	}
+	homophones := []GlossMatch{
+		{Entry: entry("神", "かみ", 0, "god")},
+		{Entry: JMDictEntry{Readings: []JMDictR_ele{{Reading: "かみ"}}}},
+	}
+	if err := flagKnownWords(homophones, sqldb); err != nil {
+		t.Fatal("fail flag known words: ", err)
+	}
+	if homophones[0].KnownWord != "" || homophones[1].KnownWord != "かみ" || homophones[1].Rank != 2 {
+		t.Errorf("expected only the kana entry to be known, got %+v", homophones)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const TOKENIZE_STATE_QUEUED = "queued"
+const TOKENIZE_STATE_RUNNING = "running"
+const TOKENIZE_STATE_FAILED = "failed"
+const TOKENIZE_STATE_DONE = "done"
+
+type tokenizeJob struct {
+	dbPath  string
+	storyID int64
+}
+
+// jobs waiting for the worker, oldest first
+var tokenizeQueue = make([]tokenizeJob, 0)
+
+// progress of queued and running jobs, and of failed jobs until the failure is read (a
+// finished job's story is marked tokenized in its db), keyed by tokenizeJobKey
+var tokenizeStatuses = make(map[string]*TokenizeStatus)
+
+// guards tokenizeQueue and tokenizeStatuses
+var tokenizeStatusesMutex sync.Mutex
+var tokenizeQueueCond = sync.NewCond(&tokenizeStatusesMutex)
+
+func tokenizeJobKey(dbPath string, storyID int64) string {
+	return dbPath + ":" + strconv.FormatInt(storyID, 10)
+}
+
+// a single worker tokenizes stories one at a time in the order they were queued
+func startTokenizeWorker() {
+	go func() {
+		for {
+			job := nextTokenizeJob()
+			err := tokenizeStory(job.dbPath, job.storyID)
+			if err != nil {
+				log.Printf("failure to tokenize story %d: %s", job.storyID, err.Error())
+			}
+		}
+	}()
+}
+
+// waits for a job if none are queued
+func nextTokenizeJob() tokenizeJob {
+	tokenizeStatusesMutex.Lock()
+	defer tokenizeStatusesMutex.Unlock()
+
+	for len(tokenizeQueue) == 0 {
+		tokenizeQueueCond.Wait()
+	}
+	job := tokenizeQueue[0]
+	tokenizeQueue = tokenizeQueue[1:]
+	return job
+}
+
+func enqueueTokenizeJob(dbPath string, storyID int64) {
+	key := tokenizeJobKey(dbPath, storyID)
+
+	tokenizeStatusesMutex.Lock()
+	defer tokenizeStatusesMutex.Unlock()
+
+	if status, ok := tokenizeStatuses[key]; ok &&
+		(status.State == TOKENIZE_STATE_QUEUED || status.State == TOKENIZE_STATE_RUNNING) {
+		return // already pending
+	}
+	tokenizeStatuses[key] = &TokenizeStatus{StoryID: storyID, State: TOKENIZE_STATE_QUEUED}
+	tokenizeQueue = append(tokenizeQueue, tokenizeJob{dbPath: dbPath, storyID: storyID})
+	tokenizeQueueCond.Signal()
+}
+
+// a copy of the job's status, if it's pending or failed; a failed status is only reported once
+func takeTokenizeStatus(dbPath string, storyID int64) (TokenizeStatus, bool) {
+	tokenizeStatusesMutex.Lock()
+	defer tokenizeStatusesMutex.Unlock()
+
+	key := tokenizeJobKey(dbPath, storyID)
+	status, ok := tokenizeStatuses[key]
+	if !ok {
+		return TokenizeStatus{}, false
+	}
+	if status.State == TOKENIZE_STATE_FAILED {
+		delete(tokenizeStatuses, key)
+	}
+	return *status, true
+}
+
+func setTokenizeStatus(dbPath string, storyID int64, update func(status *TokenizeStatus)) {
+	tokenizeStatusesMutex.Lock()
+	defer tokenizeStatusesMutex.Unlock()
+
+	key := tokenizeJobKey(dbPath, storyID)
+	status, ok := tokenizeStatuses[key]
+	if !ok {
+		status = &TokenizeStatus{StoryID: storyID}
+		tokenizeStatuses[key] = status
+	}
+	update(status)
+}
+
+// tokenizes the story's raw content and stores its lines; safe to retry
+// because words are only inserted if missing and the lines are written
+// (and the story marked tokenized) in one final update
+func tokenizeStory(dbPath string, storyID int64) (err error) {
+	defer func() {
+		if err == nil {
+			// the db now records the story as tokenized
+			tokenizeStatusesMutex.Lock()
+			delete(tokenizeStatuses, tokenizeJobKey(dbPath, storyID))
+			tokenizeStatusesMutex.Unlock()
+			return
+		}
+		setTokenizeStatus(dbPath, storyID, func(status *TokenizeStatus) {
+			status.State = TOKENIZE_STATE_FAILED
+			status.Error = err.Error()
+		})
+	}()
+
+	setTokenizeStatus(dbPath, storyID, func(status *TokenizeStatus) {
+		status.State = TOKENIZE_STATE_RUNNING
+	})
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("failure to open user db: " + err.Error())
+	}
+	defer sqldb.Close()
+
+	var content sql.NullString
+	var isTokenized bool
+	row := sqldb.QueryRow(`SELECT content, is_tokenized FROM stories WHERE id = $1;`, storyID)
+	if err := row.Scan(&content, &isTokenized); err != nil {
+		return fmt.Errorf("failure to read story: " + err.Error())
+	}
+	if isTokenized {
+		return nil
+	}
+
+	timestamps, lineContents := splitStoryContent(content.String)
+
+	lines, newWordCount, err := tokenizeStoryLines(timestamps, lineContents, sqldb,
+		func(linesDone int, linesTotal int) {
+			setTokenizeStatus(dbPath, storyID, func(status *TokenizeStatus) {
+				status.LinesDone = linesDone
+				status.LinesTotal = linesTotal
+			})
+		})
+	if err != nil {
+		return err
+	}
+
+	linesJson, err := json.Marshal(lines)
+	if err != nil {
+		return fmt.Errorf("failure to marshal lines: " + err.Error())
+	}
+
+	_, err = sqldb.Exec(`UPDATE stories SET lines = $1, is_tokenized = 1 WHERE id = $2;`, linesJson, storyID)
+	if err != nil {
+		return fmt.Errorf("failure to update story: " + err.Error())
+	}
+	if err := setStoryKanji(storyID, lines, sqldb); err != nil {
+		return err
+	}
+
+	fmt.Println("total new words added:", newWordCount)
+	return nil
+}
+
+// queues every story of every user which was created but never finished tokenizing
+func requeueUntokenizedStories() {
+	dbPaths, err := filepath.Glob("../users/*.db")
+	if err != nil {
+		log.Printf("failure to list user dbs: %s", err.Error())
+		return
+	}
+
+	for _, dbPath := range dbPaths {
+		ids, err := getUntokenizedStories(dbPath)
+		if err != nil {
+			// dbs of users who haven't logged in since tokenizing became asynchronous lack the column
+			log.Printf("skipping untokenized stories of %s: %s", dbPath, err.Error())
+			continue
+		}
+		for _, id := range ids {
+			enqueueTokenizeJob(dbPath, id)
+		}
+	}
+}
+
+func getUntokenizedStories(dbPath string) ([]int64, error) {
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failure to open user db: " + err.Error())
+	}
+	defer sqldb.Close()
+
+	rows, err := sqldb.Query(`SELECT id FROM stories WHERE is_tokenized = 0;`)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get untokenized stories: " + err.Error())
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failure to scan story id: " + err.Error())
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// poll this after creating a story to learn when its lines are ready
+func GetTokenizeStatus(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	statusCopy, ok := takeTokenizeStatus(dbPath, int64(id))
+	if ok {
+		json.NewEncoder(w).Encode(statusCopy)
+		return
+	}
+
+	// no pending or failed job, so the db is the only record
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	statusCopy = TokenizeStatus{StoryID: int64(id)}
+	err = sqldb.QueryRow(`SELECT is_tokenized FROM stories WHERE id = $1;`, id).Scan(&statusCopy.IsTokenized)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + params["id"] + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+	if statusCopy.IsTokenized {
+		statusCopy.State = TOKENIZE_STATE_DONE
+	} else {
+		statusCopy.State = TOKENIZE_STATE_FAILED
+		statusCopy.Error = "story was never tokenized; retokenize the story to try again"
+	}
+
+	json.NewEncoder(w).Encode(statusCopy)
+}
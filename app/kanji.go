@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	queryRower
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// kanji are drilled apart from words: a kanji's drill count is the number of times it was
+// reviewed directly, and its encounter count the number of times a word containing it was drilled
+func KanjiDrill(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var drillRequest DrillRequest
+	json.NewDecoder(r.Body).Decode(&drillRequest)
+
+	if drillRequest.Filter == "" {
+		drillRequest.Filter = DRILL_FILTER_ALL
+	}
+	if drillRequest.Filter != DRILL_FILTER_ALL && drillRequest.Filter != DRILL_FILTER_ON_COOLDOWN &&
+		drillRequest.Filter != DRILL_FILTER_OFF_COOLDOWN {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "invalid drill filter: " + drillRequest.Filter + `"}`))
+		return
+	}
+	if drillRequest.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "invalid drill limit: " + strconv.Itoa(drillRequest.Limit) + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	drill, err := getDrillKanji(drillRequest, time.Now().Unix(), sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(drill)
+}
+
+// kanji have no scheduler state, so they are always due by their rank cooldown
+func kanjiDueDate(kanji DrillKanji, settings UserSettings) int64 {
+	return kanji.DateMarked + settings.Cooldown(kanji.Rank)
+}
+
+// the kanji of the requested stories which pass the request's filters (but for the category mask,
+// which only applies to words), ordered with the longest overdue first
+func getDrillKanji(drillRequest DrillRequest, now int64, sqldb *sql.DB) (KanjiDrillResult, error) {
+	drill := KanjiDrillResult{Kanji: make([]DrillKanji, 0)}
+
+	kanjiIDs, allStories, err := getStoryKanji(drillRequest.StoryIds, sqldb)
+	if err != nil {
+		return drill, err
+	}
+
+	settings, err := getSettings(sqldb)
+	if err != nil {
+		return drill, err
+	}
+	drill.CountsByRank = make([]int, settings.RankCount+1)
+	drill.OffCooldownCountsByRank = make([]int, settings.RankCount+1)
+
+	rows, err := sqldb.Query(`SELECT id, character, rank, date_marked, drill_count, encounter_count FROM kanji;`)
+	if err != nil {
+		return drill, fmt.Errorf("failure to get kanji: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kanji DrillKanji
+		err = rows.Scan(&kanji.ID, &kanji.Character, &kanji.Rank, &kanji.DateMarked,
+			&kanji.DrillCount, &kanji.EncounterCount)
+		if err != nil {
+			return drill, fmt.Errorf("failure to scan kanji: " + err.Error())
+		}
+		if !allStories && !kanjiIDs[kanji.ID] {
+			continue
+		}
+
+		kanji.Due = kanjiDueDate(kanji, settings)
+		offCooldown := now > kanji.Due
+		drill.Total++
+		if kanji.Rank >= 0 && kanji.Rank < len(drill.CountsByRank) {
+			drill.CountsByRank[kanji.Rank]++
+			if offCooldown {
+				drill.OffCooldownCountsByRank[kanji.Rank]++
+			}
+		}
+
+		if (drillRequest.MinRank > 0 && kanji.Rank < drillRequest.MinRank) ||
+			(drillRequest.MaxRank > 0 && kanji.Rank > drillRequest.MaxRank) {
+			continue
+		}
+		if (drillRequest.Filter == DRILL_FILTER_OFF_COOLDOWN && !offCooldown) ||
+			(drillRequest.Filter == DRILL_FILTER_ON_COOLDOWN && offCooldown) {
+			continue
+		}
+
+		drill.Kanji = append(drill.Kanji, kanji)
+	}
+
+	sort.SliceStable(drill.Kanji, func(i, j int) bool {
+		a, b := drill.Kanji[i], drill.Kanji[j]
+		if a.Due != b.Due {
+			return a.Due < b.Due
+		}
+		if a.Rank != b.Rank {
+			return a.Rank < b.Rank
+		}
+		return a.ID < b.ID
+	})
+
+	if drillRequest.Limit > 0 && len(drill.Kanji) > drillRequest.Limit {
+		drill.Kanji = drill.Kanji[:drillRequest.Limit]
+	}
+
+	return drill, nil
+}
+
+// the ids of the kanji in the stories; like getStoryWords, a story id of -1 selects the current
+// stories, and a story id of 0 (or no story ids) selects all stories, in which case allStories is true
+func getStoryKanji(storyIds []int64, sqldb *sql.DB) (kanjiIDs map[int64]bool, allStories bool, err error) {
+	kanjiIDs = make(map[int64]bool)
+	if len(storyIds) == 0 {
+		return kanjiIDs, true, nil
+	}
+	for _, id := range storyIds {
+		if id == 0 {
+			return kanjiIDs, true, nil
+		}
+	}
+
+	var rows *sql.Rows
+	if len(storyIds) == 1 && storyIds[0] == -1 {
+		rows, err = sqldb.Query(`SELECT story_kanji.kanji FROM story_kanji
+			INNER JOIN stories ON stories.id = story_kanji.story WHERE stories.status = $1;`, STORY_STATUS_CURRENT)
+	} else {
+		ids := make([]interface{}, len(storyIds))
+		placeholders := ""
+		for i, id := range storyIds {
+			ids[i] = id
+			if i > 0 {
+				placeholders += ", "
+			}
+			placeholders += "$" + strconv.Itoa(i+1)
+		}
+		rows, err = sqldb.Query(`SELECT kanji FROM story_kanji WHERE story IN (`+placeholders+`);`, ids...)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failure to get story kanji: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, false, fmt.Errorf("failure to scan story kanji: " + err.Error())
+		}
+		kanjiIDs[id] = true
+	}
+
+	return kanjiIDs, false, nil
+}
+
+func UpdateKanji(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var kanji KanjiUpdate
+	err = json.NewDecoder(r.Body).Decode(&kanji)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if kanji.Answer != "" && kanji.Answer != REVIEW_ANSWER_CORRECT && kanji.Answer != REVIEW_ANSWER_WRONG {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "answer must be '" + REVIEW_ANSWER_CORRECT + "' or '" + REVIEW_ANSWER_WRONG + "'" + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to begin transaction: " + err.Error() + `"}`))
+		return
+	}
+	defer tx.Rollback()
+
+	kanji, err = updateKanji(kanji, tx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "cannot update kanji; kanji not found" + `"}`))
+			return
+		}
+		if errors.Is(err, errInvalidRank) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to commit kanji update: " + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(kanji)
+}
+
+// sets the kanji's rank and date marked; an answer is also counted in drill_count.
+// Returns sql.ErrNoRows if the kanji doesn't exist and errInvalidRank if the
+// rank is outside the user's rank count.
+func updateKanji(kanji KanjiUpdate, tx *sql.Tx) (KanjiUpdate, error) {
+	settings, err := getSettings(tx)
+	if err != nil {
+		return kanji, err
+	}
+	if kanji.Rank < 1 || kanji.Rank > settings.RankCount {
+		return kanji, fmt.Errorf("%w: rank must be between 1 and %d", errInvalidRank, settings.RankCount)
+	}
+
+	drilled := 0
+	if kanji.Answer != "" {
+		drilled = 1
+	}
+
+	result, err := tx.Exec(`UPDATE kanji SET rank = $1, date_marked = $2, drill_count = drill_count + $3
+		WHERE character = $4;`, kanji.Rank, kanji.DateMarked, drilled, kanji.Character)
+	if err != nil {
+		return kanji, fmt.Errorf("failure to update kanji: " + err.Error())
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return kanji, sql.ErrNoRows
+	}
+
+	row := tx.QueryRow(`SELECT drill_count, encounter_count FROM kanji WHERE character = $1;`, kanji.Character)
+	if err := row.Scan(&kanji.DrillCount, &kanji.EncounterCount); err != nil {
+		return kanji, fmt.Errorf("failure to read kanji counts: " + err.Error())
+	}
+	kanji.Due = kanjiDueDate(DrillKanji{Rank: kanji.Rank, DateMarked: kanji.DateMarked}, settings)
+
+	return kanji, nil
+}
+
+// counts a drill of the word as an encounter of each of its kanji
+func addKanjiEncounters(baseForm string, tx *sql.Tx) error {
+	seen := make(map[string]bool)
+	for _, character := range reHasKanji.FindAllString(baseForm, -1) {
+		if seen[character] {
+			continue
+		}
+		seen[character] = true
+
+		_, err := tx.Exec(`UPDATE kanji SET encounter_count = encounter_count + 1 WHERE character = $1;`, character)
+		if err != nil {
+			return fmt.Errorf("failure to update kanji encounter count: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// the id of the kanji, which is added if new; added is true if the kanji was new
+func addKanji(character string, dateAdded int64, db sqlExecer) (id int64, added bool, err error) {
+	err = db.QueryRow(`SELECT id FROM kanji WHERE character = $1;`, character).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("failure to look up kanji: " + err.Error())
+	}
+
+	result, err := db.Exec(`INSERT INTO kanji (character, rank, date_marked, date_added, drill_count, encounter_count)
+		VALUES($1, $2, $3, $4, $5, $6);`, character, INITIAL_RANK, 0, dateAdded, 0, 0)
+	if err != nil {
+		return 0, false, fmt.Errorf("failure to insert kanji: " + err.Error())
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		return 0, false, fmt.Errorf("failure to get id of inserted kanji: " + err.Error())
+	}
+	return id, true, nil
+}
+
+// replaces the story's list of kanji with the kanji of its lines
+func setStoryKanji(storyID int64, lines []Line, db sqlExecer) error {
+	_, err := db.Exec(`DELETE FROM story_kanji WHERE story = $1;`, storyID)
+	if err != nil {
+		return fmt.Errorf("failure to clear story kanji: " + err.Error())
+	}
+
+	for _, line := range lines {
+		for _, kanji := range line.Kanji {
+			if kanji.ID == 0 {
+				continue
+			}
+			_, err := db.Exec(`INSERT OR IGNORE INTO story_kanji (story, kanji) VALUES($1, $2);`, storyID, kanji.ID)
+			if err != nil {
+				return fmt.Errorf("failure to insert story kanji: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func createKanjiTables(db sqlExecer) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS kanji 
+		(id INTEGER PRIMARY KEY,
+			character TEXT NOT NULL UNIQUE,
+			rank INTEGER NOT NULL,
+			date_marked INTEGER NOT NULL,
+			date_added INTEGER NOT NULL,
+			drill_count INTEGER NOT NULL,
+			encounter_count INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("failure to create kanji table: " + err.Error())
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS story_kanji 
+		(story INTEGER NOT NULL,
+			kanji INTEGER NOT NULL,
+			PRIMARY KEY(story, kanji),
+			FOREIGN KEY(story) REFERENCES stories(id),
+			FOREIGN KEY(kanji) REFERENCES kanji(id))`)
+	if err != nil {
+		return fmt.Errorf("failure to create story_kanji table: " + err.Error())
+	}
+	return nil
+}
+
+// true until the kanji tables exist and no words are kanji
+func kanjiMigrationPending(sqldb *sql.DB) (bool, error) {
+	exists, err := tableExists(sqldb, "kanji")
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, nil
+	}
+
+	var count int
+	err = sqldb.QueryRow(`SELECT COUNT(*) FROM words WHERE category & $1 != 0;`, DRILL_CATEGORY_KANJI).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failure to count kanji words: " + err.Error())
+	}
+	return count > 0, nil
+}
+
+// kanji used to be rows of the words table (with DRILL_CATEGORY_KANJI), and the kanji of
+// story lines referred to word ids; this creates the kanji tables, copies the kanji rows into
+// the kanji table and points the lines and the per-story kanji lists at the new ids. A single
+// kanji word (e.g. 家) shared its row with its kanji, so a row which story lines use as a word
+// is kept as a word, minus the kanji category; the other kanji rows are removed with their
+// history.
+func migrateKanji(sqldb *sql.DB) error {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := createKanjiTables(tx); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id, lines FROM stories WHERE lines IS NOT NULL;`)
+	if err != nil {
+		return fmt.Errorf("failure to get stories: " + err.Error())
+	}
+	stories := make(map[int64][]Line)
+	lineWords := make(map[string]bool)
+	for rows.Next() {
+		var id int64
+		var linesJSON string
+		var lines []Line
+		if err := rows.Scan(&id, &linesJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failure to scan story lines: " + err.Error())
+		}
+		if err := json.Unmarshal([]byte(linesJSON), &lines); err != nil {
+			rows.Close()
+			return fmt.Errorf("failure to unmarshall story lines: " + err.Error())
+		}
+		stories[id] = lines
+		for _, line := range lines {
+			for _, word := range line.Words {
+				lineWords[word.BaseForm] = true
+			}
+		}
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO kanji (character, rank, date_marked, date_added, drill_count, encounter_count)
+		SELECT base_form, rank, date_marked, date_added, drill_count, 0 FROM words WHERE category & $1 != 0;`,
+		DRILL_CATEGORY_KANJI)
+	if err != nil {
+		return fmt.Errorf("failure to copy kanji: " + err.Error())
+	}
+
+	rows, err = tx.Query(`SELECT id, base_form FROM words WHERE category & $1 != 0;`, DRILL_CATEGORY_KANJI)
+	if err != nil {
+		return fmt.Errorf("failure to get kanji words: " + err.Error())
+	}
+	kanjiWords := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var baseForm string
+		if err := rows.Scan(&id, &baseForm); err != nil {
+			rows.Close()
+			return fmt.Errorf("failure to scan kanji word: " + err.Error())
+		}
+		kanjiWords[id] = baseForm
+	}
+	rows.Close()
+
+	for id, baseForm := range kanjiWords {
+		if lineWords[baseForm] {
+			_, err = tx.Exec(`UPDATE words SET category = category & ~$1 WHERE id = $2;`, DRILL_CATEGORY_KANJI, id)
+			if err != nil {
+				return fmt.Errorf("failure to update kanji word: " + err.Error())
+			}
+			continue
+		}
+		for _, table := range []string{"reviews", "word_schedules", "word_notes"} {
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE word = $1;`, id)
+			if err != nil {
+				return fmt.Errorf("failure to delete kanji from " + table + ": " + err.Error())
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM words WHERE id = $1;`, id)
+		if err != nil {
+			return fmt.Errorf("failure to delete kanji from words: " + err.Error())
+		}
+	}
+
+	date := time.Now().Unix()
+	for id, lines := range stories {
+		for i := range lines {
+			for j := range lines[i].Kanji {
+				kanji := &lines[i].Kanji[j]
+				if kanji.Character == "" {
+					continue
+				}
+				kanji.ID, _, err = addKanji(kanji.Character, date, tx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		linesJSON, err := json.Marshal(lines)
+		if err != nil {
+			return fmt.Errorf("failure to marshal lines: " + err.Error())
+		}
+		_, err = tx.Exec(`UPDATE stories SET lines = $1 WHERE id = $2;`, linesJSON, id)
+		if err != nil {
+			return fmt.Errorf("failure to update story lines: " + err.Error())
+		}
+		if err := setStoryKanji(id, lines, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failure to commit kanji migration: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// a wrong answer to a word whose last answer was correct is a lapse; a word which lapses
+// as many times as the user's leech threshold becomes a leech and, if the user's settings
+// say so, is suspended from drills. Must be called before the answer's review is added.
+func addLapse(wordID int64, settings UserSettings, tx *sql.Tx) error {
+	var lastCorrect bool
+	row := tx.QueryRow(`SELECT correct FROM reviews WHERE word = $1 ORDER BY date DESC, id DESC LIMIT 1;`, wordID)
+	if err := row.Scan(&lastCorrect); err != nil {
+		if err == sql.ErrNoRows {
+			return nil // the first answer can't be a lapse
+		}
+		return fmt.Errorf("failure to get last review: " + err.Error())
+	}
+	if !lastCorrect {
+		return nil
+	}
+
+	_, err := tx.Exec(`UPDATE words SET lapses = lapses + 1 WHERE id = $1;`, wordID)
+	if err != nil {
+		return fmt.Errorf("failure to count lapse: " + err.Error())
+	}
+
+	_, err = tx.Exec(`UPDATE words SET leech = 1, suspended = $1 WHERE id = $2 AND leech = 0 AND lapses >= $3;`,
+		*settings.SuspendLeeches, wordID, settings.LeechThreshold)
+	if err != nil {
+		return fmt.Errorf("failure to flag leech: " + err.Error())
+	}
+	return nil
+}
+
+// the words flagged as leeches, most lapsed first
+func GetLeeches(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	leeches, err := getLeeches(sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(leeches)
+}
+
+func getLeeches(sqldb *sql.DB) ([]Leech, error) {
+	rows, err := sqldb.Query(`SELECT words.base_form, words.rank, words.date_marked, words.drill_count,
+			words.lapses, words.suspended, IFNULL(SUM(reviews.correct), 0), COUNT(reviews.id)
+		FROM words LEFT JOIN reviews ON reviews.word = words.id
+		WHERE words.leech = 1
+		GROUP BY words.id
+		ORDER BY words.lapses DESC, words.base_form;`)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get leeches: " + err.Error())
+	}
+	defer rows.Close()
+
+	leeches := make([]Leech, 0)
+	for rows.Next() {
+		var leech Leech
+		var correct, total int
+		err := rows.Scan(&leech.BaseForm, &leech.Rank, &leech.DateMarked, &leech.DrillCount,
+			&leech.Lapses, &leech.Suspended, &correct, &total)
+		if err != nil {
+			return nil, fmt.Errorf("failure to scan leech: " + err.Error())
+		}
+		if total > 0 {
+			leech.Accuracy = float64(correct) / float64(total)
+		}
+		leeches = append(leeches, leech)
+	}
+	return leeches, nil
+}
+
+// suspends or unsuspends a word; clearing the leech flag also resets the word's lapses,
+// so a reworked word gets a fresh start
+func UpdateLeech(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var update LeechUpdate
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	err = updateLeech(update, sqldb)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "word not found: " + update.BaseForm + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(update)
+}
+
+// returns sql.ErrNoRows if the word doesn't exist
+func updateLeech(update LeechUpdate, sqldb *sql.DB) error {
+	query := `UPDATE words SET suspended = $1 WHERE base_form = $2;`
+	if update.ClearLeech {
+		query = `UPDATE words SET suspended = $1, leech = 0, lapses = 0 WHERE base_form = $2;`
+	}
+
+	result, err := sqldb.Exec(query, update.Suspended, update.BaseForm)
+	if err != nil {
+		return fmt.Errorf("failure to update leech: " + err.Error())
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
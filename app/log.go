@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// record a read of the story, unless the story was already read within the log cooldown
+func AddLogEvent(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	story, logged, err := addLogEvent(int64(id), time.Now().Unix(), sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if !logged {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(bson.M{
+			"message": "story cannot be logged right now because it was read in the last " +
+				strconv.Itoa(STORY_LOG_COOLDOWN/(60*60)) + " hours",
+			"story": story})
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"message": "logged read of story: " + story.Title, "story": story})
+}
+
+// inserts a log event for the story and updates the story's counts in one transaction;
+// returns false (and makes no change) if the story was already logged within the cooldown
+func addLogEvent(storyID int64, date int64, sqldb *sql.DB) (Story, bool, error) {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return Story{}, false, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	story := Story{ID: storyID}
+	row := tx.QueryRow(`SELECT title FROM stories WHERE id = $1;`, storyID)
+	if err := row.Scan(&story.Title); err != nil {
+		return Story{}, false, fmt.Errorf("failure to get story: " + err.Error())
+	}
+
+	// the cooldown check is part of the insert so that two simultaneous requests can't both log
+	result, err := tx.Exec(`INSERT INTO log_events (story, date)
+			SELECT $1, $2 WHERE NOT EXISTS
+			(SELECT id FROM log_events WHERE story = $1 AND date > $3);`,
+		storyID, date, date-STORY_LOG_COOLDOWN)
+	if err != nil {
+		return Story{}, false, fmt.Errorf("failure to insert log event: " + err.Error())
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return Story{}, false, fmt.Errorf("failure to insert log event: " + err.Error())
+	}
+
+	if inserted > 0 {
+		_, err = tx.Exec(`UPDATE stories SET countdown = MAX(countdown - 1, 0),
+				read_count = read_count + 1, date_last_read = $1 WHERE id = $2;`,
+			date, storyID)
+		if err != nil {
+			return Story{}, false, fmt.Errorf("failure to update story counts: " + err.Error())
+		}
+
+		if err := dequeueStoryRead(storyID, tx); err != nil {
+			return Story{}, false, err
+		}
+	}
+
+	row = tx.QueryRow(`SELECT status, countdown, read_count, date_last_read FROM stories WHERE id = $1;`, storyID)
+	if err := row.Scan(&story.Status, &story.Countdown, &story.ReadCount, &story.DateLastRead); err != nil {
+		return Story{}, false, fmt.Errorf("failure to read story counts: " + err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Story{}, false, fmt.Errorf("failure to commit log event: " + err.Error())
+	}
+
+	return story, inserted > 0, nil
+}
+
+// log events of one story (if the route has an id) or of all stories, most recent first
+func GetLogEvents(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	storyID := int64(-1)
+	params := mux.Vars(r)
+	if idStr, ok := params["id"]; ok {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
+		storyID = int64(id)
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	events, err := getLogEvents(storyID, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(events)
+}
+
+// storyID of -1 gets the log events of all stories
+func getLogEvents(storyID int64, sqldb *sql.DB) ([]LogEvent, error) {
+	var rows *sql.Rows
+	var err error
+	if storyID == -1 {
+		rows, err = sqldb.Query(`SELECT l.id, l.story, l.date, s.title FROM log_events l
+			INNER JOIN stories s ON l.story = s.id ORDER BY l.date DESC;`)
+	} else {
+		rows, err = sqldb.Query(`SELECT l.id, l.story, l.date, s.title FROM log_events l
+			INNER JOIN stories s ON l.story = s.id WHERE l.story = $1 ORDER BY l.date DESC;`, storyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure to get log events: " + err.Error())
+	}
+	defer rows.Close()
+
+	events := make([]LogEvent, 0)
+	for rows.Next() {
+		var event LogEvent
+		if err := rows.Scan(&event.ID, &event.StoryID, &event.Date, &event.Title); err != nil {
+			return nil, fmt.Errorf("failure to scan log event: " + err.Error())
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var errInvalidEntry = errors.New("invalid entry")
+
+// sets the user's note, mnemonic, gloss and primary dictionary entry of a word;
+// every field is replaced, so an empty field clears it
+func UpdateWordNote(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var note WordNote
+	err = json.NewDecoder(r.Body).Decode(&note)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	err = updateWordNote(note, sqldb)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "word not found: " + note.BaseForm + `"}`))
+			return
+		}
+		if errors.Is(err, errInvalidEntry) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(note)
+}
+
+// returns sql.ErrNoRows if the word doesn't exist and errInvalidEntry if the primary
+// entry isn't one of the word's dictionary entries
+func updateWordNote(note WordNote, sqldb *sql.DB) error {
+	var wordID int64
+	if err := sqldb.QueryRow(`SELECT id FROM words WHERE base_form = $1;`, note.BaseForm).Scan(&wordID); err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("failure to get word: " + err.Error())
+	}
+
+	if note.PrimaryEntry != "" {
+		found := false
+		for _, entry := range getDefinitions(note.BaseForm) {
+			if entryKey(entry) == note.PrimaryEntry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: no entry %s for %s", errInvalidEntry, note.PrimaryEntry, note.BaseForm)
+		}
+	}
+
+	if note.Note == "" && note.Mnemonic == "" && note.Gloss == "" && note.PrimaryEntry == "" {
+		_, err := sqldb.Exec(`DELETE FROM word_notes WHERE word = $1;`, wordID)
+		if err != nil {
+			return fmt.Errorf("failure to delete word note: " + err.Error())
+		}
+		return nil
+	}
+
+	_, err := sqldb.Exec(`INSERT OR REPLACE INTO word_notes (word, note, mnemonic, gloss, primary_entry)
+		VALUES($1, $2, $3, $4, $5);`, wordID, note.Note, note.Mnemonic, note.Gloss, note.PrimaryEntry)
+	if err != nil {
+		return fmt.Errorf("failure to update word note: " + err.Error())
+	}
+	return nil
+}
+
+// the notes of every word which has any, keyed by word id
+func getWordNotes(sqldb *sql.DB) (map[int64]WordNote, error) {
+	rows, err := sqldb.Query(`SELECT word_notes.word, words.base_form, word_notes.note, word_notes.mnemonic,
+			word_notes.gloss, word_notes.primary_entry
+		FROM word_notes INNER JOIN words ON words.id = word_notes.word;`)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get word notes: " + err.Error())
+	}
+	defer rows.Close()
+
+	notes := make(map[int64]WordNote)
+	for rows.Next() {
+		var wordID int64
+		var note WordNote
+		if err := rows.Scan(&wordID, &note.BaseForm, &note.Note, &note.Mnemonic, &note.Gloss, &note.PrimaryEntry); err != nil {
+			return nil, fmt.Errorf("failure to scan word note: " + err.Error())
+		}
+		notes[wordID] = note
+	}
+	return notes, nil
+}
+
+// JMdict entries are identified by their sequence number; homographs getDefinitions returns
+// for a base form can share their spellings and readings
+func entryKey(entry JMDictEntry) string {
+	return entry.Ent_seq
+}
+
+// the word info sent to the client for a word in the words table: its definitions
+// (with the user's primary entry first), its drill state and the user's notes
+func getWordInfo(word DrillWord, note WordNote) WordInfo {
+	info := WordInfo{
+		Definitions:  getDefinitions(word.BaseForm),
+		Rank:         word.Rank,
+		DateMarked:   word.DateMarked,
+		Due:          word.Due,
+		Note:         note.Note,
+		Mnemonic:     note.Mnemonic,
+		Gloss:        note.Gloss,
+		PrimaryEntry: note.PrimaryEntry,
+	}
+
+	if note.PrimaryEntry != "" {
+		// the definitions are shared with the cache, so reorder a copy
+		definitions := make([]JMDictEntry, 0, len(info.Definitions))
+		for _, entry := range info.Definitions {
+			if entryKey(entry) == note.PrimaryEntry {
+				definitions = append(definitions, entry)
+			}
+		}
+		for _, entry := range info.Definitions {
+			if entryKey(entry) != note.PrimaryEntry {
+				definitions = append(definitions, entry)
+			}
+		}
+		info.Definitions = definitions
+	}
+
+	return info
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const QUEUE_MAX_ENQUEUE_COUNT = 20
+
+// add the story to the end of the queue (possibly several times)
+func EnqueueStory(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var enqueue EnqueueRequest
+	err = json.NewDecoder(r.Body).Decode(&enqueue)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if enqueue.Count == 0 {
+		enqueue.Count = 1
+	}
+	if enqueue.Count < 0 || enqueue.Count > QUEUE_MAX_ENQUEUE_COUNT {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "enqueue count must be between 1 and " + strconv.Itoa(QUEUE_MAX_ENQUEUE_COUNT) + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	var id int64
+	err = sqldb.QueryRow(`SELECT id FROM stories WHERE id = $1;`, enqueue.StoryId).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + strconv.FormatInt(enqueue.StoryId, 10) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+
+	err = enqueueStory(enqueue.StoryId, enqueue.Count, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	queue, err := getQueue(0, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(queue)
+}
+
+func enqueueStory(storyID int64, count int, sqldb *sql.DB) error {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	var lastPosition int
+	row := tx.QueryRow(`SELECT IFNULL(MAX(position), -1) FROM queued_stories;`)
+	if err := row.Scan(&lastPosition); err != nil {
+		return fmt.Errorf("failure to get end of queue: " + err.Error())
+	}
+
+	date := time.Now().Unix()
+	for i := 1; i <= count; i++ {
+		_, err = tx.Exec(`INSERT INTO queued_stories (story, date, position) VALUES($1, $2, $3);`,
+			storyID, date, lastPosition+i)
+		if err != nil {
+			return fmt.Errorf("failure to enqueue story: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failure to commit enqueued story: " + err.Error())
+	}
+	return nil
+}
+
+// the request lists every queue entry id in the new order
+func ReorderQueue(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var reorder QueueReorderRequest
+	err = json.NewDecoder(r.Body).Decode(&reorder)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	queue, err := getQueue(0, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if !isQueuePermutation(queue, reorder.IDs) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "reordered queue must list every queued entry exactly once" + `"}`))
+		return
+	}
+
+	err = reorderQueue(reorder.IDs, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	queue, err = getQueue(0, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(queue)
+}
+
+func isQueuePermutation(queue []EnqueuedStory, ids []int64) bool {
+	if len(queue) != len(ids) {
+		return false
+	}
+	remaining := make(map[int64]bool)
+	for _, entry := range queue {
+		remaining[entry.ID] = true
+	}
+	for _, id := range ids {
+		if !remaining[id] {
+			return false
+		}
+		delete(remaining, id)
+	}
+	return true
+}
+
+func reorderQueue(ids []int64, sqldb *sql.DB) error {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		_, err = tx.Exec(`UPDATE queued_stories SET position = $1 WHERE id = $2;`, i, id)
+		if err != nil {
+			return fmt.Errorf("failure to reorder queue: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failure to commit reordered queue: " + err.Error())
+	}
+	return nil
+}
+
+// remove a single entry from the queue without logging a read
+func Dequeue(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var dequeue DequeueRequest
+	err = json.NewDecoder(r.Body).Decode(&dequeue)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	result, err := sqldb.Exec(`DELETE FROM queued_stories WHERE id = $1;`, dequeue.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to dequeue story: " + err.Error() + `"}`))
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "queue entry does not exist: " + strconv.FormatInt(dequeue.ID, 10) + `"}`))
+		return
+	}
+
+	queue, err := getQueue(0, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(queue)
+}
+
+// reading a story consumes its first entry in the queue
+func dequeueStoryRead(storyID int64, tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM queued_stories WHERE id =
+		(SELECT id FROM queued_stories WHERE story = $1 ORDER BY position, id LIMIT 1);`, storyID)
+	if err != nil {
+		return fmt.Errorf("failure to dequeue read story: " + err.Error())
+	}
+	return nil
+}
+
+// the queue in order; an optional limit query param returns only the next n entries
+func GetQueue(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "invalid queue limit: " + limitStr + `"}`))
+			return
+		}
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	queue, err := getQueue(limit, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(queue)
+}
+
+// limit of 0 gets the whole queue
+func getQueue(limit int, sqldb *sql.DB) ([]EnqueuedStory, error) {
+	if limit <= 0 {
+		limit = -1 // no limit in sqlite
+	}
+	rows, err := sqldb.Query(`SELECT q.id, q.story, q.date, s.title, s.link FROM queued_stories q
+		INNER JOIN stories s ON q.story = s.id ORDER BY q.position, q.id LIMIT $1;`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get queue: " + err.Error())
+	}
+	defer rows.Close()
+
+	queue := make([]EnqueuedStory, 0)
+	for rows.Next() {
+		var entry EnqueuedStory
+		if err := rows.Scan(&entry.ID, &entry.StoryID, &entry.Date, &entry.Title, &entry.Link); err != nil {
+			return nil, fmt.Errorf("failure to scan queue entry: " + err.Error())
+		}
+		queue = append(queue, entry)
+	}
+
+	return queue, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const REVIEW_ANSWER_CORRECT = "correct"
+const REVIEW_ANSWER_WRONG = "wrong"
+
+var errInvalidAnswer = errors.New("invalid answer")
+
+// the number of most recent reviews returned unless the request asks for a different limit
+const REVIEW_DEFAULT_LIMIT = 36
+
+// records an answer and counts it in the word's drill_count
+func addReview(wordID int64, date int64, correct bool, oldRank int, newRank int, tx *sql.Tx) error {
+	_, err := tx.Exec(`INSERT INTO reviews (word, date, correct, old_rank, new_rank) VALUES($1, $2, $3, $4, $5);`,
+		wordID, date, correct, oldRank, newRank)
+	if err != nil {
+		return fmt.Errorf("failure to insert review: " + err.Error())
+	}
+
+	_, err = tx.Exec(`UPDATE words SET drill_count = drill_count + 1 WHERE id = $1;`, wordID)
+	if err != nil {
+		return fmt.Errorf("failure to update drill count: " + err.Error())
+	}
+	return nil
+}
+
+// the word's accuracy and its most recent reviews; an optional limit query param
+// sets how many reviews to return (0 for all)
+func GetWordReviews(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	baseForm := params["baseForm"]
+
+	limit := REVIEW_DEFAULT_LIMIT
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "invalid review limit: " + limitStr + `"}`))
+			return
+		}
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	history, err := getWordReviews(baseForm, limit, sqldb)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "word not found: " + baseForm + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
+
+// limit of 0 gets every review; returns sql.ErrNoRows if the word doesn't exist
+func getWordReviews(baseForm string, limit int, sqldb *sql.DB) (WordReviewHistory, error) {
+	history := WordReviewHistory{BaseForm: baseForm, Reviews: make([]WordReview, 0)}
+
+	var wordID int64
+	row := sqldb.QueryRow(`SELECT id, drill_count FROM words WHERE base_form = $1;`, baseForm)
+	if err := row.Scan(&wordID, &history.DrillCount); err != nil {
+		if err == sql.ErrNoRows {
+			return history, err
+		}
+		return history, fmt.Errorf("failure to get word: " + err.Error())
+	}
+
+	row = sqldb.QueryRow(`SELECT IFNULL(SUM(correct), 0), COUNT(*) FROM reviews WHERE word = $1;`, wordID)
+	var total int
+	if err := row.Scan(&history.Correct, &total); err != nil {
+		return history, fmt.Errorf("failure to count reviews: " + err.Error())
+	}
+	history.Wrong = total - history.Correct
+	if total > 0 {
+		history.Accuracy = float64(history.Correct) / float64(total)
+	}
+
+	if limit <= 0 {
+		limit = -1 // no limit in sqlite
+	}
+	rows, err := sqldb.Query(`SELECT id, word, date, correct, old_rank, new_rank FROM reviews
+		WHERE word = $1 ORDER BY date DESC, id DESC LIMIT $2;`, wordID, limit)
+	if err != nil {
+		return history, fmt.Errorf("failure to get reviews: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var review WordReview
+		err := rows.Scan(&review.ID, &review.WordID, &review.Date, &review.Correct, &review.OldRank, &review.NewRank)
+		if err != nil {
+			return history, fmt.Errorf("failure to scan review: " + err.Error())
+		}
+		history.Reviews = append(history.Reviews, review)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+)
+
+const SCHEDULER_RANK = "rank"
+const SCHEDULER_SM2 = "sm2"
+const SCHEDULER_FSRS = "fsrs"
+const DEFAULT_SCHEDULER = SCHEDULER_RANK
+
+const SECONDS_PER_DAY = 60 * 60 * 24
+
+// decides when a word is next due for drilling
+type Scheduler interface {
+	Name() string
+	// the word's state after an answer at time now; state is the zero
+	// value (but for WordID and Scheduler) on the word's first review
+	Review(state WordSchedule, correct bool, now int64) WordSchedule
+	// the time the word should next be drilled; state is nil if the word
+	// has never been reviewed with this scheduler
+	DueDate(word DrillWord, state *WordSchedule, settings UserSettings) int64
+}
+
+var schedulers = map[string]Scheduler{
+	SCHEDULER_RANK: RankScheduler{},
+	SCHEDULER_SM2:  SM2Scheduler{},
+	SCHEDULER_FSRS: FSRSScheduler{},
+}
+
+func getScheduler(name string) (Scheduler, bool) {
+	scheduler, ok := schedulers[name]
+	return scheduler, ok
+}
+
+// the original scheme: a word is due a fixed cooldown after it was last marked, by rank
+type RankScheduler struct{}
+
+func (RankScheduler) Name() string {
+	return SCHEDULER_RANK
+}
+
+func (RankScheduler) Review(state WordSchedule, correct bool, now int64) WordSchedule {
+	state.Repetitions++
+	state.LastReview = now
+	return state
+}
+
+// the rank (which the user sets) decides, so the state is ignored
+func (RankScheduler) DueDate(word DrillWord, state *WordSchedule, settings UserSettings) int64 {
+	return drillDueDate(word, settings)
+}
+
+// SuperMemo 2 with binary answers: correct is graded 4 and wrong 1
+type SM2Scheduler struct{}
+
+const SM2_INITIAL_EASE = 2.5
+const SM2_MIN_EASE = 1.3
+const SM2_GRADE_CORRECT = 4
+const SM2_GRADE_WRONG = 1
+
+func (SM2Scheduler) Name() string {
+	return SCHEDULER_SM2
+}
+
+func (SM2Scheduler) Review(state WordSchedule, correct bool, now int64) WordSchedule {
+	if state.Ease == 0 {
+		state.Ease = SM2_INITIAL_EASE
+	}
+
+	grade := float64(SM2_GRADE_WRONG)
+	if correct {
+		grade = SM2_GRADE_CORRECT
+	}
+
+	if correct {
+		switch state.Repetitions {
+		case 0:
+			state.Interval = 1
+		case 1:
+			state.Interval = 6
+		default:
+			state.Interval = math.Round(state.Interval * state.Ease)
+		}
+		state.Repetitions++
+	} else {
+		state.Repetitions = 0
+		state.Interval = 1
+	}
+
+	state.Ease += 0.1 - (5-grade)*(0.08+(5-grade)*0.02)
+	if state.Ease < SM2_MIN_EASE {
+		state.Ease = SM2_MIN_EASE
+	}
+
+	state.LastReview = now
+	state.Due = now + int64(state.Interval*SECONDS_PER_DAY)
+	return state
+}
+
+// words never reviewed with SM-2 fall back to their rank cooldown
+func (SM2Scheduler) DueDate(word DrillWord, state *WordSchedule, settings UserSettings) int64 {
+	if state == nil {
+		return drillDueDate(word, settings)
+	}
+	return state.Due
+}
+
+// FSRS 4.5 with binary answers: correct is graded Good and wrong Again
+type FSRSScheduler struct{}
+
+// the default FSRS 4.5 parameters
+var fsrsWeights = [17]float64{0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755}
+
+const FSRS_GRADE_AGAIN = 1
+const FSRS_GRADE_GOOD = 3
+const FSRS_DESIRED_RETENTION = 0.9
+const FSRS_DECAY = -0.5
+const FSRS_FACTOR = 19.0 / 81.0
+const FSRS_MAX_INTERVAL = 36500 // days
+
+func (FSRSScheduler) Name() string {
+	return SCHEDULER_FSRS
+}
+
+func (FSRSScheduler) Review(state WordSchedule, correct bool, now int64) WordSchedule {
+	w := fsrsWeights
+	grade := float64(FSRS_GRADE_AGAIN)
+	if correct {
+		grade = FSRS_GRADE_GOOD
+	}
+
+	initialDifficulty := func(grade float64) float64 {
+		return w[4] - (grade-3)*w[5]
+	}
+
+	if state.Stability == 0 {
+		// first review
+		state.Stability = w[int(grade)-1]
+		state.Difficulty = clamp(initialDifficulty(grade), 1, 10)
+	} else {
+		elapsedDays := math.Max(float64(now-state.LastReview)/SECONDS_PER_DAY, 0)
+		retrievability := math.Pow(1+FSRS_FACTOR*elapsedDays/state.Stability, FSRS_DECAY)
+
+		difficulty := state.Difficulty - w[6]*(grade-3)
+		state.Difficulty = clamp(w[7]*initialDifficulty(FSRS_GRADE_GOOD)+(1-w[7])*difficulty, 1, 10)
+
+		if correct {
+			state.Stability *= 1 + math.Exp(w[8])*(11-state.Difficulty)*math.Pow(state.Stability, -w[9])*
+				(math.Exp(w[10]*(1-retrievability))-1)
+		} else {
+			forgotten := w[11] * math.Pow(state.Difficulty, -w[12]) *
+				(math.Pow(state.Stability+1, w[13]) - 1) * math.Exp(w[14]*(1-retrievability))
+			state.Stability = math.Min(forgotten, state.Stability)
+		}
+	}
+
+	interval := state.Stability / FSRS_FACTOR * (math.Pow(FSRS_DESIRED_RETENTION, 1/FSRS_DECAY) - 1)
+	state.Interval = clamp(math.Round(interval), 1, FSRS_MAX_INTERVAL)
+	if correct {
+		state.Repetitions++
+	} else {
+		state.Repetitions = 0
+	}
+
+	state.LastReview = now
+	state.Due = now + int64(state.Interval*SECONDS_PER_DAY)
+	return state
+}
+
+// words never reviewed with FSRS fall back to their rank cooldown
+func (FSRSScheduler) DueDate(word DrillWord, state *WordSchedule, settings UserSettings) int64 {
+	if state == nil {
+		return drillDueDate(word, settings)
+	}
+	return state.Due
+}
+
+func clamp(x float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, x))
+}
+
+// the state of the word under the scheduler; nil if the word has never been reviewed with it
+func getWordSchedule(wordID int64, scheduler string, tx *sql.Tx) (*WordSchedule, error) {
+	state := WordSchedule{WordID: wordID, Scheduler: scheduler}
+	row := tx.QueryRow(`SELECT ease, interval, stability, difficulty, repetitions, due, last_review
+		FROM word_schedules WHERE word = $1 AND scheduler = $2;`, wordID, scheduler)
+	err := row.Scan(&state.Ease, &state.Interval, &state.Stability, &state.Difficulty,
+		&state.Repetitions, &state.Due, &state.LastReview)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure to get word schedule: " + err.Error())
+	}
+	return &state, nil
+}
+
+func putWordSchedule(state WordSchedule, tx *sql.Tx) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO word_schedules
+		(word, scheduler, ease, interval, stability, difficulty, repetitions, due, last_review)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		state.WordID, state.Scheduler, state.Ease, state.Interval, state.Stability, state.Difficulty,
+		state.Repetitions, state.Due, state.LastReview)
+	if err != nil {
+		return fmt.Errorf("failure to store word schedule: " + err.Error())
+	}
+	return nil
+}
+
+// the states of all words under the scheduler, keyed by word id
+func getWordSchedules(scheduler string, sqldb *sql.DB) (map[int64]*WordSchedule, error) {
+	rows, err := sqldb.Query(`SELECT word, ease, interval, stability, difficulty, repetitions, due, last_review
+		FROM word_schedules WHERE scheduler = $1;`, scheduler)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get word schedules: " + err.Error())
+	}
+	defer rows.Close()
+
+	states := make(map[int64]*WordSchedule)
+	for rows.Next() {
+		state := WordSchedule{Scheduler: scheduler}
+		err := rows.Scan(&state.WordID, &state.Ease, &state.Interval, &state.Stability, &state.Difficulty,
+			&state.Repetitions, &state.Due, &state.LastReview)
+		if err != nil {
+			return nil, fmt.Errorf("failure to scan word schedule: " + err.Error())
+		}
+		states[state.WordID] = &state
+	}
+	return states, nil
+}
+
+// updates the word's state under the user's scheduler after an answer
+func scheduleReview(wordID int64, correct bool, now int64, tx *sql.Tx) error {
+	settings, err := getSettings(tx)
+	if err != nil {
+		return err
+	}
+	scheduler, ok := getScheduler(settings.Scheduler)
+	if !ok {
+		return fmt.Errorf("unknown scheduler: " + settings.Scheduler)
+	}
+
+	state, err := getWordSchedule(wordID, scheduler.Name(), tx)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &WordSchedule{WordID: wordID, Scheduler: scheduler.Name()}
+	}
+
+	return putWordSchedule(scheduler.Review(*state, correct, now), tx)
+}
+
+// the user's settings and a function giving the due date of a word under the user's scheduler
+func getDueDateFunc(sqldb *sql.DB) (UserSettings, func(word DrillWord) int64, error) {
+	settings, err := getSettings(sqldb)
+	if err != nil {
+		return settings, nil, err
+	}
+	scheduler, ok := getScheduler(settings.Scheduler)
+	if !ok {
+		return settings, nil, fmt.Errorf("unknown scheduler: " + settings.Scheduler)
+	}
+	states, err := getWordSchedules(scheduler.Name(), sqldb)
+	if err != nil {
+		return settings, nil, err
+	}
+
+	return settings, func(word DrillWord) int64 {
+		return scheduler.DueDate(word, states[word.ID], settings)
+	}, nil
+}
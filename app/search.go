@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// the number of entries returned unless the search asks for a different limit
+const WORD_SEARCH_DEFAULT_LIMIT = 50
+
+var kanjiSpellingIndex *suffixIndex
+var readingIndex *suffixIndex
+
+// a suffix array over a set of strings: every suffix of every string, in sorted order, so
+// the strings containing a word are found by binary searching for the suffixes it prefixes
+type suffixIndex struct {
+	keys     []string
+	suffixes []indexSuffix
+}
+
+// keys[key][offset:]; offsets are in bytes, at rune boundaries
+type indexSuffix struct {
+	key    int32
+	offset int32
+}
+
+// built after buildEntryMaps, over the distinct kanji spellings and readings
+func buildSearchIndexes() {
+	kanjiSpellingIndex = newSuffixIndex(allEntriesByKanjiSpellings)
+	readingIndex = newSuffixIndex(allEntriesByReading)
+}
+
+func newSuffixIndex(entriesByKey map[string][]*JMDictEntry) *suffixIndex {
+	index := &suffixIndex{
+		keys:     make([]string, 0, len(entriesByKey)),
+		suffixes: make([]indexSuffix, 0),
+	}
+	for key := range entriesByKey {
+		for offset := range key {
+			index.suffixes = append(index.suffixes, indexSuffix{key: int32(len(index.keys)), offset: int32(offset)})
+		}
+		index.keys = append(index.keys, key)
+	}
+	sort.Slice(index.suffixes, func(i, j int) bool {
+		return index.suffix(index.suffixes[i]) < index.suffix(index.suffixes[j])
+	})
+	return index
+}
+
+func (index *suffixIndex) suffix(s indexSuffix) string {
+	return index.keys[s.key][s.offset:]
+}
+
+// the keys which start with the word and the keys which contain it elsewhere; a key in
+// startKeys is not repeated in midKeys
+func (index *suffixIndex) search(word string) (startKeys []string, midKeys []string) {
+	startKeys = make([]string, 0)
+	midKeys = make([]string, 0)
+	if word == "" {
+		return startKeys, midKeys
+	}
+
+	first := sort.Search(len(index.suffixes), func(i int) bool {
+		return index.suffix(index.suffixes[i]) >= word
+	})
+
+	isStart := make(map[int32]bool)
+	isMid := make(map[int32]bool)
+	for i := first; i < len(index.suffixes) && strings.HasPrefix(index.suffix(index.suffixes[i]), word); i++ {
+		s := index.suffixes[i]
+		if s.offset == 0 {
+			isStart[s.key] = true
+		} else {
+			isMid[s.key] = true
+		}
+	}
+
+	for key := range isStart {
+		startKeys = append(startKeys, index.keys[key])
+	}
+	for key := range isMid {
+		if !isStart[key] {
+			midKeys = append(midKeys, index.keys[key])
+		}
+	}
+
+	// a stable order, so the pages of a search don't shift between requests
+	sort.Strings(startKeys)
+	sort.Strings(midKeys)
+	return startKeys, midKeys
+}
+
+// the entries whose kanji spellings (or if the word has no kanji, readings) start with the
+// word, then those which contain it elsewhere, each sorted by sortResults; offset and limit
+// page through the two lists as one
+func searchEntries(word string, offset int, limit int) WordSearchResult {
+	hasKanji := len(reHasKanji.FindStringIndex(word)) > 0
+	index, entriesByKey := readingIndex, allEntriesByReading
+	if hasKanji {
+		index, entriesByKey = kanjiSpellingIndex, allEntriesByKanjiSpellings
+	}
+
+	entriesStart := make([]*JMDictEntry, 0)
+	entriesMid := make([]*JMDictEntry, 0)
+	if index != nil {
+		startKeys, midKeys := index.search(word)
+
+		// an entry with several matching spellings is listed once, as a start match if any
+		// of its spellings start with the word
+		seen := make(map[*JMDictEntry]bool)
+		for _, key := range startKeys {
+			for _, entry := range entriesByKey[key] {
+				if !seen[entry] {
+					seen[entry] = true
+					entriesStart = append(entriesStart, entry)
+				}
+			}
+		}
+		for _, key := range midKeys {
+			for _, entry := range entriesByKey[key] {
+				if !seen[entry] {
+					seen[entry] = true
+					entriesMid = append(entriesMid, entry)
+				}
+			}
+		}
+	}
+
+	sortResults(entriesStart, hasKanji, word)
+	sortResults(entriesMid, hasKanji, word)
+
+	pageStart := pageEntries(entriesStart, offset, limit)
+	pageMid := pageEntries(entriesMid, offset-len(entriesStart), limit-len(pageStart))
+	return WordSearchResult{
+		EntriesStart: copyEntries(pageStart, word),
+		CountStart:   len(entriesStart),
+		EntriesMid:   copyEntries(pageMid, word),
+		CountMid:     len(entriesMid),
+	}
+}
+
+// entries[offset:offset+limit], clamped to the entries
+func pageEntries(entries []*JMDictEntry, offset int, limit int) []*JMDictEntry {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	if end < offset {
+		end = offset
+	}
+	return entries[offset:end]
+}
+
+// copies of the (shared) entries, with their shortest kanji spelling and reading containing
+// the word set
+func copyEntries(entries []*JMDictEntry, word string) []JMDictEntry {
+	copies := make([]JMDictEntry, len(entries))
+	for i, entry := range entries {
+		copies[i] = *entry
+		copies[i].ShortestKanjiSpelling, copies[i].ShortestReading = shortestMatches(entry, word)
+	}
+	return copies
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// each user db has a single settings row
+const SETTINGS_ROW_ID = 1
+
+// ranks are set with the digit keys
+const SETTINGS_MAX_RANK_COUNT = 9
+
+const DEFAULT_RANK_COUNT = 4
+
+const DEFAULT_LEECH_THRESHOLD = 8
+
+var errInvalidSettings = errors.New("invalid settings")
+var errInvalidRank = errors.New("invalid rank")
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func GetSettings(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	settings, err := getSettings(sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(settings)
+}
+
+func UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var settings UserSettings
+	err = json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	settings, err = updateSettings(settings, sqldb)
+	if err != nil {
+		if errors.Is(err, errInvalidSettings) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(settings)
+}
+
+func getSettings(db queryRower) (UserSettings, error) {
+	suspendLeeches := false
+	settings := UserSettings{Scheduler: DEFAULT_SCHEDULER, RankCount: DEFAULT_RANK_COUNT,
+		LeechThreshold: DEFAULT_LEECH_THRESHOLD, SuspendLeeches: &suspendLeeches}
+	var cooldownsJSON string
+	row := db.QueryRow(`SELECT scheduler, rank_count, cooldowns, leech_threshold, suspend_leeches
+		FROM settings WHERE id = $1;`, SETTINGS_ROW_ID)
+	if err := row.Scan(&settings.Scheduler, &settings.RankCount, &cooldownsJSON,
+		&settings.LeechThreshold, settings.SuspendLeeches); err != nil {
+		if err != sql.ErrNoRows {
+			return settings, fmt.Errorf("failure to get settings: " + err.Error())
+		}
+	}
+
+	if cooldownsJSON != "" {
+		if err := json.Unmarshal([]byte(cooldownsJSON), &settings.Cooldowns); err != nil {
+			return settings, fmt.Errorf("failure to unmarshal cooldowns: " + err.Error())
+		}
+	}
+	if len(settings.Cooldowns) != settings.RankCount {
+		settings.Cooldowns = defaultCooldowns(settings.RankCount)
+	}
+
+	return settings, nil
+}
+
+// the built-in cooldowns, with any ranks past the last one getting the last one's cooldown;
+// each call returns a new slice, so callers may change it
+func defaultCooldowns(rankCount int) []int64 {
+	builtIn := []int64{DRILL_COOLDOWN_RANK_1, DRILL_COOLDOWN_RANK_2, DRILL_COOLDOWN_RANK_3, DRILL_COOLDOWN_RANK_4}
+	cooldowns := make([]int64, rankCount)
+	for i := range cooldowns {
+		if i < len(builtIn) {
+			cooldowns[i] = builtIn[i]
+		} else {
+			cooldowns[i] = builtIn[len(builtIn)-1]
+		}
+	}
+	return cooldowns
+}
+
+// the number of seconds after being marked that a word of the rank is due again
+func (settings UserSettings) Cooldown(rank int) int64 {
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(settings.Cooldowns) {
+		rank = len(settings.Cooldowns)
+	}
+	return settings.Cooldowns[rank-1]
+}
+
+// zero fields of the update keep their current values; when the rank count shrinks,
+// words above the new top rank are moved down to it
+func updateSettings(update UserSettings, sqldb *sql.DB) (UserSettings, error) {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	settings, err := getSettings(tx)
+	if err != nil {
+		return UserSettings{}, err
+	}
+	oldRankCount := settings.RankCount
+
+	if update.Scheduler != "" {
+		if _, ok := getScheduler(update.Scheduler); !ok {
+			return UserSettings{}, fmt.Errorf("%w: unknown scheduler: %s", errInvalidSettings, update.Scheduler)
+		}
+		settings.Scheduler = update.Scheduler
+	}
+
+	if update.RankCount != 0 {
+		if update.RankCount < 1 || update.RankCount > SETTINGS_MAX_RANK_COUNT {
+			return UserSettings{}, fmt.Errorf("%w: rank count must be between 1 and %d", errInvalidSettings, SETTINGS_MAX_RANK_COUNT)
+		}
+		settings.RankCount = update.RankCount
+	}
+
+	if update.Cooldowns != nil {
+		settings.Cooldowns = update.Cooldowns
+	} else if settings.RankCount < len(settings.Cooldowns) {
+		settings.Cooldowns = settings.Cooldowns[:settings.RankCount]
+	} else {
+		// new ranks get the default cooldowns
+		settings.Cooldowns = append(settings.Cooldowns, defaultCooldowns(settings.RankCount)[len(settings.Cooldowns):]...)
+	}
+	if len(settings.Cooldowns) != settings.RankCount {
+		return UserSettings{}, fmt.Errorf("%w: expected a cooldown for each of the %d ranks", errInvalidSettings, settings.RankCount)
+	}
+	for _, cooldown := range settings.Cooldowns {
+		if cooldown <= 0 {
+			return UserSettings{}, fmt.Errorf("%w: cooldowns must be positive", errInvalidSettings)
+		}
+	}
+
+	if update.LeechThreshold != 0 {
+		if update.LeechThreshold < 1 {
+			return UserSettings{}, fmt.Errorf("%w: leech threshold must be positive", errInvalidSettings)
+		}
+		settings.LeechThreshold = update.LeechThreshold
+	}
+	if update.SuspendLeeches != nil {
+		settings.SuspendLeeches = update.SuspendLeeches
+	}
+
+	cooldownsJSON, err := json.Marshal(settings.Cooldowns)
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("failure to marshal cooldowns: " + err.Error())
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO settings (id, scheduler, rank_count, cooldowns, leech_threshold, suspend_leeches)
+		VALUES($1, $2, $3, $4, $5, $6);`, SETTINGS_ROW_ID, settings.Scheduler, settings.RankCount, string(cooldownsJSON),
+		settings.LeechThreshold, *settings.SuspendLeeches)
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("failure to update settings: " + err.Error())
+	}
+
+	if settings.RankCount < oldRankCount {
+		_, err = tx.Exec(`UPDATE words SET rank = $1 WHERE rank > $1;`, settings.RankCount)
+		if err != nil {
+			return UserSettings{}, fmt.Errorf("failure to migrate word ranks: " + err.Error())
+		}
+		_, err = tx.Exec(`UPDATE kanji SET rank = $1 WHERE rank > $1;`, settings.RankCount)
+		if err != nil {
+			return UserSettings{}, fmt.Errorf("failure to migrate kanji ranks: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UserSettings{}, fmt.Errorf("failure to commit settings: " + err.Error())
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const SECONDS_PER_WEEK = 7 * SECONDS_PER_DAY
+
+// weeks start on monday; the unix epoch was a thursday
+const WEEK_START_OFFSET = 4 * SECONDS_PER_DAY
+
+const STATS_FORECAST_DAYS = 30
+
+// word categories reported in the stats; a word may be in more than one
+var statsCategories = []struct {
+	Name string
+	Mask int
+}{
+	{"katakana", DRILL_CATEGORY_KATAKANA},
+	{"ichidan", DRILL_CATEGORY_ICHIDAN},
+	{"godan", DRILL_CATEGORY_GODAN},
+}
+
+// a summary of the user's words and reviews for the drill page's dashboard
+func GetDrillStats(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	stats, err := getDrillStats(time.Now().Unix(), sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+func getDrillStats(now int64, sqldb *sql.DB) (DrillStats, error) {
+	settings, dueDate, err := getDueDateFunc(sqldb)
+	if err != nil {
+		return DrillStats{}, err
+	}
+
+	stats := DrillStats{
+		CountsByRank:     make([]int, settings.RankCount+1),
+		CountsByCategory: make(map[string]int),
+		WordsAddedByWeek: make([]WeekCount, 0),
+		DueForecast:      make([]int, STATS_FORECAST_DAYS),
+		AccuracyByRank:   make([]RankAccuracy, 0),
+	}
+	for _, category := range statsCategories {
+		stats.CountsByCategory[category.Name] = 0
+	}
+
+	rows, err := sqldb.Query(`SELECT id, rank, date_marked, date_added, category, suspended FROM words;`)
+	if err != nil {
+		return stats, fmt.Errorf("failure to get words: " + err.Error())
+	}
+	defer rows.Close()
+
+	addedByWeek := make(map[int64]int)
+	for rows.Next() {
+		var word DrillWord
+		var dateAdded int64
+		var suspended bool
+		if err := rows.Scan(&word.ID, &word.Rank, &word.DateMarked, &dateAdded, &word.Category, &suspended); err != nil {
+			return stats, fmt.Errorf("failure to scan word: " + err.Error())
+		}
+
+		stats.TotalWords++
+		if word.Rank >= 0 && word.Rank < len(stats.CountsByRank) {
+			stats.CountsByRank[word.Rank]++
+		}
+		for _, category := range statsCategories {
+			if word.Category&category.Mask != 0 {
+				stats.CountsByCategory[category.Name]++
+			}
+		}
+		addedByWeek[weekStart(dateAdded)]++
+
+		if suspended {
+			stats.Suspended++
+			continue // never due
+		}
+		due := dueDate(word)
+		if due <= now {
+			stats.Overdue++
+		} else if day := (due - now) / SECONDS_PER_DAY; day < STATS_FORECAST_DAYS {
+			stats.DueForecast[day]++
+		}
+	}
+	rows.Close()
+
+	if err := sqldb.QueryRow(`SELECT COUNT(*) FROM kanji;`).Scan(&stats.TotalKanji); err != nil {
+		return stats, fmt.Errorf("failure to count kanji: " + err.Error())
+	}
+	stats.CountsByCategory["kanji"] = stats.TotalKanji
+
+	// every week from the first word added to this week, including weeks with no words added
+	if len(addedByWeek) > 0 {
+		first := weekStart(now)
+		for week := range addedByWeek {
+			if week < first {
+				first = week
+			}
+		}
+		for week := first; week <= weekStart(now); week += SECONDS_PER_WEEK {
+			stats.WordsAddedByWeek = append(stats.WordsAddedByWeek, WeekCount{WeekStart: week, Count: addedByWeek[week]})
+		}
+	}
+
+	// a review's rank is the rank the word had when it was answered
+	rows, err = sqldb.Query(`SELECT old_rank, SUM(correct), COUNT(*) FROM reviews GROUP BY old_rank ORDER BY old_rank;`)
+	if err != nil {
+		return stats, fmt.Errorf("failure to get review accuracy: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var accuracy RankAccuracy
+		if err := rows.Scan(&accuracy.Rank, &accuracy.Correct, &accuracy.Total); err != nil {
+			return stats, fmt.Errorf("failure to scan review accuracy: " + err.Error())
+		}
+		accuracy.Accuracy = float64(accuracy.Correct) / float64(accuracy.Total)
+		stats.AccuracyByRank = append(stats.AccuracyByRank, accuracy)
+	}
+
+	return stats, nil
+}
+
+// the start of the week (monday, midnight UTC) containing the time
+func weekStart(date int64) int64 {
+	return (date-WEEK_START_OFFSET)/SECONDS_PER_WEEK*SECONDS_PER_WEEK + WEEK_START_OFFSET
+}
@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-	//"unicode/utf8"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/ikawaha/kagome/v2/tokenizer"
@@ -30,9 +34,22 @@ const STORY_STATUS_CURRENT = 2
 const STORY_STATUS_NEVER_READ = 1
 const STORY_STATUS_ARCHIVE = 0
 const STORY_INITIAL_STATUS = STORY_STATUS_NEVER_READ
+const STORY_DEFAULT_COUNTDOWN = 5 // number of reads planned when a story becomes current
+
+// the statuses each status is allowed to change to
+var storyStatusTransitions = map[int][]int{
+	STORY_STATUS_NEVER_READ: {STORY_STATUS_CURRENT, STORY_STATUS_ARCHIVE},
+	STORY_STATUS_CURRENT:    {STORY_STATUS_ARCHIVE},
+	STORY_STATUS_ARCHIVE:    {STORY_STATUS_CURRENT},
+}
 
 const STORY_LOG_COOLDOWN = 60 * 60 * 8 // 8 hour cooldown (in seconds)
 
+var errDuplicateTitle = errors.New("story with same title already exists")
+
+// the story's status was changed by another request since it was read
+var errStatusChanged = errors.New("story status has changed")
+
 func CreateStory(response http.ResponseWriter, request *http.Request) {
 	dbPath, redirect, err := GetUserDb(response, request)
 	if redirect || err != nil {
@@ -52,14 +69,21 @@ func CreateStory(response http.ResponseWriter, request *http.Request) {
 	}
 	defer sqldb.Close()
 
-	_, newWordCount, err := addStory(story, sqldb, false)
+	// the lines are tokenized in the background; see GetTokenizeStatus
+	id, err := insertUntokenizedStory(story, sqldb)
 	if err != nil {
+		if errors.Is(err, errDuplicateTitle) {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
 		response.WriteHeader(http.StatusInternalServerError)
 		response.Write([]byte(`{ "message": "` + err.Error() + `"}`))
 		return
 	}
-	fmt.Println("total new words added:", newWordCount)
-	json.NewEncoder(response).Encode("Success adding story")
+	enqueueTokenizeJob(dbPath, id)
+
+	json.NewEncoder(response).Encode(Story{ID: id, Title: story.Title, Link: story.Link, IsTokenized: false})
 }
 
 func RetokenizeStory(response http.ResponseWriter, request *http.Request) {
@@ -81,6 +105,20 @@ func RetokenizeStory(response http.ResponseWriter, request *http.Request) {
 	}
 	defer sqldb.Close()
 
+	// a story whose background tokenization never finished is tokenized from its raw content
+	var isTokenized bool
+	err = sqldb.QueryRow(`SELECT is_tokenized FROM stories WHERE id = $1;`, story.ID).Scan(&isTokenized)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+	if !isTokenized {
+		enqueueTokenizeJob(dbPath, story.ID)
+		json.NewEncoder(response).Encode("Story queued for tokenizing")
+		return
+	}
+
 	_, newWordCount, err := addStory(story, sqldb, true)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
@@ -91,6 +129,361 @@ func RetokenizeStory(response http.ResponseWriter, request *http.Request) {
 	json.NewEncoder(response).Encode("Success retokenizing story")
 }
 
+// edit the title, link and/or raw content of a story; new content is retokenized
+// and aligned with the old lines so unchanged lines keep their marks and timestamps
+func EditStory(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var edit EditStoryRequest
+	err = json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	if edit.Title != nil && strings.TrimSpace(*edit.Title) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "story title cannot be empty" + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	var isTokenized bool
+	err = sqldb.QueryRow(`SELECT is_tokenized FROM stories WHERE id = $1;`, edit.StoryID).Scan(&isTokenized)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + strconv.FormatInt(edit.StoryID, 10) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+	if edit.Content != nil && !isTokenized {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "cannot edit the content of a story which is still being tokenized" + `"}`))
+		return
+	}
+
+	newWordCount, err := editStory(edit, sqldb)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story not found: " + strconv.FormatInt(edit.StoryID, 10) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	fmt.Println("total new words added:", newWordCount)
+
+	story, err := getStory(edit.StoryID, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(story)
+}
+
+// the edits are made in one transaction; returns sql.ErrNoRows if the story doesn't exist
+func editStory(edit EditStoryRequest, sqldb *sql.DB) (newWordCount int, err error) {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	var linesJSON string
+	err = tx.QueryRow(`SELECT lines FROM stories WHERE id = $1;`, edit.StoryID).Scan(&linesJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failure to read story: " + err.Error())
+	}
+
+	if edit.Title != nil {
+		_, err = tx.Exec(`UPDATE stories SET title = $1 WHERE id = $2;`, strings.TrimSpace(*edit.Title), edit.StoryID)
+		if err != nil {
+			return 0, fmt.Errorf("failure to update story title (titles must be unique): " + err.Error())
+		}
+	}
+
+	if edit.Link != nil {
+		_, err = tx.Exec(`UPDATE stories SET link = $1 WHERE id = $2;`, strings.TrimSpace(*edit.Link), edit.StoryID)
+		if err != nil {
+			return 0, fmt.Errorf("failure to update story link (links must be unique): " + err.Error())
+		}
+	}
+
+	if edit.Content != nil {
+		var oldLines []Line
+		err = json.Unmarshal([]byte(linesJSON), &oldLines)
+		if err != nil {
+			return 0, fmt.Errorf("failure to unmarshall story lines: " + err.Error())
+		}
+
+		timestamps, lineContents := splitStoryContent(*edit.Content)
+		var lines []Line
+		lines, newWordCount, err = tokenizeStoryLines(timestamps, lineContents, tx, nil)
+		if err != nil {
+			return 0, err
+		}
+		lines = alignLines(oldLines, lines)
+
+		linesBytes, err := json.Marshal(lines)
+		if err != nil {
+			return 0, fmt.Errorf("failure to JSONify story lines: " + err.Error())
+		}
+
+		_, err = tx.Exec(`UPDATE stories SET lines = $1, content = $2 WHERE id = $3;`,
+			linesBytes, *edit.Content, edit.StoryID)
+		if err != nil {
+			return 0, fmt.Errorf("failure to update story content: " + err.Error())
+		}
+		if err := setStoryKanji(edit.StoryID, lines, tx); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failure to commit story edit: " + err.Error())
+	}
+	return newWordCount, nil
+}
+
+func DeleteStory(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var deleteRequest DeleteStoryRequest
+	err = json.NewDecoder(r.Body).Decode(&deleteRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	var title string
+	var audio sql.NullString
+	err = sqldb.QueryRow(`SELECT title, audio FROM stories WHERE id = $1;`, deleteRequest.StoryID).Scan(&title, &audio)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + strconv.FormatInt(deleteRequest.StoryID, 10) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+
+	result, err := deleteStory(deleteRequest, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	result.Title = title
+
+	// uploaded audio is named after the story; audio in the shared static directory is left alone
+	if !deleteRequest.DryRun && audio.String != "" && !strings.ContainsRune(audio.String, '/') {
+		os.Remove(filepath.Join(getUserAudioDir(dbPath), audio.String))
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// removes the story and everything recorded about it; if requested, also removes
+// the words and kanji which appear in no other story, except those already drilled
+// or noted (or, for kanji, encountered in a drilled word)
+func deleteStory(deleteRequest DeleteStoryRequest, sqldb *sql.DB) (DeleteStoryResult, error) {
+	result := DeleteStoryResult{
+		StoryID:      deleteRequest.StoryID,
+		DryRun:       deleteRequest.DryRun,
+		RemovedWords: make([]string, 0),
+		KeptWords:    make([]string, 0),
+		RemovedKanji: make([]string, 0),
+		KeptKanji:    make([]string, 0),
+	}
+
+	if deleteRequest.RemoveWords {
+		uniqueWords, err := getUniqueStoryWords(deleteRequest.StoryID, sqldb)
+		if err != nil {
+			return DeleteStoryResult{}, err
+		}
+
+		for baseForm := range uniqueWords {
+			var rank, drillCount int
+			var dateMarked int64
+			var hasNote bool
+			row := sqldb.QueryRow(`SELECT rank, drill_count, date_marked,
+				EXISTS(SELECT 1 FROM word_notes WHERE word_notes.word = words.id)
+				FROM words WHERE base_form = $1;`, baseForm)
+			err := row.Scan(&rank, &drillCount, &dateMarked, &hasNote)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return DeleteStoryResult{}, fmt.Errorf("failure to get word: " + err.Error())
+			}
+
+			if drillCount > 0 || dateMarked > 0 || rank != INITIAL_RANK || hasNote {
+				result.KeptWords = append(result.KeptWords, baseForm)
+			} else {
+				result.RemovedWords = append(result.RemovedWords, baseForm)
+			}
+		}
+		sort.Strings(result.RemovedWords)
+		sort.Strings(result.KeptWords)
+
+		uniqueKanji, err := getUniqueStoryKanji(deleteRequest.StoryID, sqldb)
+		if err != nil {
+			return DeleteStoryResult{}, err
+		}
+		for _, kanji := range uniqueKanji {
+			if kanji.DrillCount > 0 || kanji.EncounterCount > 0 || kanji.DateMarked > 0 || kanji.Rank != INITIAL_RANK {
+				result.KeptKanji = append(result.KeptKanji, kanji.Character)
+			} else {
+				result.RemovedKanji = append(result.RemovedKanji, kanji.Character)
+			}
+		}
+	}
+
+	if deleteRequest.DryRun {
+		return result, nil
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return DeleteStoryResult{}, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"log_events", "queued_stories", "story_status_changes", "story_kanji"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE story = $1;`, deleteRequest.StoryID)
+		if err != nil {
+			return DeleteStoryResult{}, fmt.Errorf("failure to delete story from " + table + ": " + err.Error())
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM stories WHERE id = $1;`, deleteRequest.StoryID)
+	if err != nil {
+		return DeleteStoryResult{}, fmt.Errorf("failure to delete story: " + err.Error())
+	}
+
+	for _, baseForm := range result.RemovedWords {
+		_, err = tx.Exec(`DELETE FROM words WHERE base_form = $1;`, baseForm)
+		if err != nil {
+			return DeleteStoryResult{}, fmt.Errorf("failure to delete word: " + err.Error())
+		}
+	}
+
+	for _, character := range result.RemovedKanji {
+		_, err = tx.Exec(`DELETE FROM kanji WHERE character = $1;`, character)
+		if err != nil {
+			return DeleteStoryResult{}, fmt.Errorf("failure to delete kanji: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DeleteStoryResult{}, fmt.Errorf("failure to commit story deletion: " + err.Error())
+	}
+
+	return result, nil
+}
+
+// the base forms of the story which appear in no other story
+func getUniqueStoryWords(storyID int64, sqldb *sql.DB) (map[string]bool, error) {
+	baseForms, err := getStoryWords([]int64{storyID}, sqldb)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(`SELECT lines FROM stories WHERE id != $1;`, storyID)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get other stories: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var linesJSON string
+		var lines []Line
+		if err := rows.Scan(&linesJSON); err != nil {
+			return nil, fmt.Errorf("failure to scan story lines: " + err.Error())
+		}
+		if err := json.Unmarshal([]byte(linesJSON), &lines); err != nil {
+			return nil, fmt.Errorf("failure to unmarshall story lines: " + err.Error())
+		}
+
+		for _, line := range lines {
+			for _, word := range line.Words {
+				delete(baseForms, word.BaseForm)
+			}
+		}
+	}
+
+	return baseForms, nil
+}
+
+// the kanji of the story which are in no other story's kanji list, in character order
+func getUniqueStoryKanji(storyID int64, sqldb *sql.DB) ([]DrillKanji, error) {
+	rows, err := sqldb.Query(`SELECT kanji.id, kanji.character, kanji.rank, kanji.date_marked,
+			kanji.drill_count, kanji.encounter_count
+		FROM kanji INNER JOIN story_kanji ON story_kanji.kanji = kanji.id
+		WHERE story_kanji.story = $1 AND NOT EXISTS
+			(SELECT 1 FROM story_kanji AS other WHERE other.kanji = kanji.id AND other.story != $1)
+		ORDER BY kanji.character;`, storyID)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get story kanji: " + err.Error())
+	}
+	defer rows.Close()
+
+	kanji := make([]DrillKanji, 0)
+	for rows.Next() {
+		var k DrillKanji
+		err := rows.Scan(&k.ID, &k.Character, &k.Rank, &k.DateMarked, &k.DrillCount, &k.EncounterCount)
+		if err != nil {
+			return nil, fmt.Errorf("failure to scan story kanji: " + err.Error())
+		}
+		kanji = append(kanji, k)
+	}
+	return kanji, nil
+}
+
 func tokenize(content string) ([]*JpToken, []string, error) {
 	analyzerTokens := tok.Analyze(content, tokenizer.Normal)
 	tokens := make([]*JpToken, len(analyzerTokens))
@@ -143,12 +536,7 @@ func addStory(story Story, sqldb *sql.DB, retokenize bool) (id int64, newWordCou
 		if err != nil {
 			return 0, 0, fmt.Errorf("failure to unmarshall story lines: " + err.Error())
 		}
-		for _, line := range story.Lines {
-			story.Content += line.Timestamp + "\n"
-			for _, word := range line.Words {
-				story.Content += word.Surface
-			}
-		}
+		story.Content = linesToContent(story.Lines)
 	} else {
 		row := sqldb.QueryRow(`SELECT id FROM stories WHERE title = $1;`, story.Title)
 		if err := row.Scan(&story.ID); err != nil && err != sql.ErrNoRows {
@@ -156,26 +544,254 @@ func addStory(story Story, sqldb *sql.DB, retokenize bool) (id int64, newWordCou
 		}
 	}
 
-	// if text has timestamps, split on timestamps,
-	// otherwise split on blank lines
-	timestampRegex := regexp.MustCompile(`(?m)^\s*\d*:\d*\s*$`) // match timestamp line
-	timestamps := timestampRegex.FindAllString(story.Content, -1)
-	lineContents := timestampRegex.Split(story.Content, -1)
+	timestamps, lineContents := splitStoryContent(story.Content)
+
+	lines, newWordCount, err := tokenizeStoryLines(timestamps, lineContents, sqldb, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if retokenize {
+		lines = alignLines(story.Lines, lines)
+	}
+
+	linesJson, err := json.Marshal(lines)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failure to lines: " + err.Error())
+	}
+
+	if retokenize {
+		_, err = sqldb.Exec(`UPDATE stories SET lines = $1, is_tokenized = 1 WHERE id = $2;`,
+			linesJson, story.ID)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failure to update story: " + err.Error())
+		}
+		if err := setStoryKanji(story.ID, lines, sqldb); err != nil {
+			return 0, 0, err
+		}
+		return story.ID, newWordCount, nil
+	} else {
+		date := time.Now().Unix()
+		result, err := sqldb.Exec(`INSERT INTO stories (lines, title, link, date_added, status, audio, countdown, read_count, date_last_read, content, is_tokenized) 
+				VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 1);`,
+			linesJson, story.Title, story.Link, date, STORY_INITIAL_STATUS, "", 0, 0, 0, story.Content)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failure to insert story: " + err.Error())
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failure to insert story: " + err.Error())
+		}
+		if err := setStoryKanji(id, lines, sqldb); err != nil {
+			return 0, 0, err
+		}
+		return id, newWordCount, nil
+	}
+}
+
+// the text of the lines in the form splitStoryContent expects, each preceded by its timestamp
+func linesToContent(lines []Line) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(line.Timestamp + "\n")
+		for _, word := range line.Words {
+			sb.WriteString(word.Surface)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// the line's text without whitespace or 。, for comparing lines across retokenizing; the lines
+// of stories tokenized before punctuateNewlines lack the 。 it now inserts
+func lineText(line Line) string {
+	var sb strings.Builder
+	for _, word := range line.Words {
+		sb.WriteString(word.Surface)
+	}
+	return comparableText(sb.String())
+}
+
+func comparableText(text string) string {
+	return strings.ReplaceAll(strings.Join(strings.Fields(text), ""), "。", "")
+}
+
+// carries the marks, timestamps and manual splits of the old lines over to the
+// retokenized lines wherever the text is unchanged; lines are aligned by longest
+// common subsequence, where a new line may also match a run of consecutive old lines
+// whose joined text equals its own (i.e. a line the user had split), in which case
+// it's split again at the same places
+func alignLines(oldLines []Line, newLines []Line) []Line {
+	oldTexts := make([]string, len(oldLines))
+	for i := range oldLines {
+		oldTexts[i] = lineText(oldLines[i])
+	}
+	newTexts := make([]string, len(newLines))
+	for i := range newLines {
+		newTexts[i] = lineText(newLines[i])
+	}
+
+	// matchEnd[i][j] is the end of the run of old lines starting at i which matches new line j (0 if none)
+	matchEnd := make([][]int, len(oldLines)+1)
+	// lcs[i][j] is the number of new lines matched in aligning oldLines[i:] with newLines[j:]
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		matchEnd[i] = make([]int, len(newLines)+1)
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			lcs[i][j] = lcs[i+1][j]
+			if lcs[i][j+1] > lcs[i][j] {
+				lcs[i][j] = lcs[i][j+1]
+			}
+			if k, ok := matchSplitLines(oldTexts, i, newTexts[j]); ok {
+				matchEnd[i][j] = k
+				if lcs[k][j+1]+1 > lcs[i][j] {
+					lcs[i][j] = lcs[k][j+1] + 1
+				}
+			}
+		}
+	}
+
+	aligned := make([]Line, 0, len(newLines))
+	i, j := 0, 0
+	for j < len(newLines) {
+		if i < len(oldLines) {
+			if k := matchEnd[i][j]; k > 0 && lcs[i][j] == lcs[k][j+1]+1 {
+				if k-i == 1 {
+					aligned = append(aligned, carryLineMetadata(oldLines[i], newLines[j]))
+				} else {
+					aligned = append(aligned, resplitLine(oldLines[i:k], newLines[j])...)
+				}
+				i = k
+				j++
+				continue
+			}
+			if lcs[i][j] == lcs[i+1][j] {
+				i++ // old line removed
+				continue
+			}
+		}
+		aligned = append(aligned, newLines[j]) // new or edited line
+		j++
+	}
+
+	return aligned
+}
+
+func carryLineMetadata(oldLine Line, newLine Line) Line {
+	newLine.Marked = oldLine.Marked
+	// an explicit timestamp in the new content takes precedence
+	if newLine.Timestamp == "0:00" {
+		newLine.Timestamp = oldLine.Timestamp
+	}
+	return newLine
+}
+
+// finds k such that oldTexts[start:k] joined equals text
+func matchSplitLines(oldTexts []string, start int, text string) (int, bool) {
+	joined := ""
+	for k := start; k < len(oldTexts); k++ {
+		joined += oldTexts[k]
+		if joined == text {
+			return k + 1, true
+		}
+		if oldTexts[k] == "" || !strings.HasPrefix(text, joined) {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// splits the new line where the old lines were split; if a split falls inside a word
+// (the retokenizing grouped characters differently), the rest stays in one line
+func resplitLine(oldLines []Line, newLine Line) []Line {
+	lines := make([]Line, 0, len(oldLines))
+	rest := newLine
+	for idx, oldLine := range oldLines[:len(oldLines)-1] {
+		target := lineText(oldLine)
+		text := ""
+		wordIdx := -1
+		for w, word := range rest.Words {
+			text += comparableText(word.Surface)
+			if text == target {
+				// an inserted 。 ends the old line
+				wordIdx = w + 1
+				if wordIdx < len(rest.Words) && rest.Words[wordIdx].Surface == "。" {
+					wordIdx++
+				}
+				break
+			}
+			if len(text) > len(target) {
+				break
+			}
+		}
+		if wordIdx <= 0 || wordIdx >= len(rest.Words) {
+			rest = carryLineMetadata(oldLines[idx], rest)
+			return append(lines, rest)
+		}
+
+		var first Line
+		first, rest = splitLineAt(rest, wordIdx, oldLines[idx+1].Timestamp)
+		lines = append(lines, carryLineMetadata(oldLine, first))
+	}
+	return append(lines, carryLineMetadata(oldLines[len(oldLines)-1], rest))
+}
+
+// inserts the story with its raw content but no lines; the lines are filled in later by tokenizeStory
+func insertUntokenizedStory(story Story, sqldb *sql.DB) (int64, error) {
+	var existingID int64
+	err := sqldb.QueryRow(`SELECT id FROM stories WHERE title = $1;`, story.Title).Scan(&existingID)
+	if err == nil {
+		return 0, fmt.Errorf("%w: %s", errDuplicateTitle, story.Title)
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failure to check for story with same title: " + err.Error())
+	}
+
+	date := time.Now().Unix()
+	result, err := sqldb.Exec(`INSERT INTO stories (lines, title, link, date_added, status, audio, countdown, read_count, date_last_read, content, is_tokenized) 
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0);`,
+		"[]", story.Title, story.Link, date, STORY_INITIAL_STATUS, "", 0, 0, 0, story.Content)
+	if err != nil {
+		return 0, fmt.Errorf("failure to insert story: " + err.Error())
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failure to insert story: " + err.Error())
+	}
+	return id, nil
+}
+
+// if text has timestamps, split on timestamps,
+// otherwise split on blank lines
+func splitStoryContent(content string) (timestamps []string, lineContents []string) {
+	timestampRegex := regexp.MustCompile(`(?m)^\s*\d*:\d*(\.\d+)?\s*$`) // match timestamp line
+	timestamps = timestampRegex.FindAllString(content, -1)
+	lineContents = timestampRegex.Split(content, -1)
 
 	if len(timestamps) > 0 {
 		// todo: check that the timestamps increase in value
 		lineContents = lineContents[1:]
 	} else {
 		blanklinesRegex := regexp.MustCompile(`(?m)^\s*$\n`) // match timestamp line
-		lineContents = blanklinesRegex.Split(story.Content, -1)
+		lineContents = blanklinesRegex.Split(content, -1)
 		if len(lineContents) > 0 && lineContents[0] == "" {
 			lineContents = lineContents[1:]
 		}
 	}
 
+	return timestamps, lineContents
+}
+
+// tokenizes each line, adding any new words and kanji to the words and kanji tables;
+// progress (if not nil) is called after each line
+func tokenizeStoryLines(timestamps []string, lineContents []string, sqldb sqlExecer,
+	progress func(linesDone int, linesTotal int)) ([]Line, int, error) {
 	lines := make([]Line, len(lineContents))
 
-	newWordCount = 0
+	newWordCount := 0
 
 	for i, content := range lineContents {
 		timestamp := "0:00"
@@ -187,50 +803,126 @@ func addStory(story Story, sqldb *sql.DB, retokenize bool) (id int64, newWordCou
 
 		//fmt.Println(timestamp, content)
 
+		if len(timestamps) > 0 {
+			content = punctuateNewlines(content)
+		} else {
+			// blank lines separate paragraphs, so the end of each line's content also ends a sentence
+			content = strings.TrimSuffix(punctuateNewlines(content+"\n"), "\n")
+		}
+
 		tokens, kanjiSet, err := tokenize(content)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failure to tokenize story: " + err.Error())
+			return nil, 0, fmt.Errorf("failure to tokenize story: " + err.Error())
 		}
 
 		wordsOfLine, lineKanji, addedWordCount, err := addWords(tokens, kanjiSet, sqldb)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failure to add words: " + err.Error())
+			return nil, 0, fmt.Errorf("failure to add words: " + err.Error())
 		}
 		newWordCount += addedWordCount
 
 		lines[i] = Line{
-			Timestamp: timestamp,
-			Words:     wordsOfLine,
-			Kanji:     lineKanji,
+			Timestamp:  timestamp,
+			Words:      wordsOfLine,
+			Kanji:      lineKanji,
+			Paragraphs: buildParagraphs(wordsOfLine),
+		}
+
+		if progress != nil {
+			progress(i+1, len(lineContents))
 		}
 	}
 
-	linesJson, err := json.Marshal(lines)
-	if err != nil {
-		return 0, 0, fmt.Errorf("failure to lines: " + err.Error())
+	return lines, newWordCount, nil
+}
+
+const SENTENCE_END_PUNCTUATION = "。！？!?…‥"
+const OPENING_BRACKETS = "「『（(【"
+const CLOSING_BRACKETS = "」』）)】"
+
+// ends every line which doesn't already end a sentence with a 。, so that
+// sentence boundaries survive tokenizing; lines ending mid-sentence with a comma are left alone
+func punctuateNewlines(content string) string {
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines)-1; i++ {
+		trimmed := strings.TrimRightFunc(lines[i], unicode.IsSpace)
+		if trimmed == "" {
+			continue
+		}
+		last, _ := utf8.DecodeLastRuneInString(trimmed)
+		if strings.ContainsRune(SENTENCE_END_PUNCTUATION+CLOSING_BRACKETS+".、，,", last) {
+			continue
+		}
+		lines[i] = trimmed + "。" + lines[i][len(trimmed):]
 	}
+	return strings.Join(lines, "\n")
+}
 
-	if retokenize {
-		_, err = sqldb.Exec(`UPDATE stories SET lines = $1 WHERE id = $2;`,
-			linesJson, story.ID)
-		if err != nil {
-			return 0, 0, fmt.Errorf("failure to update story: " + err.Error())
+// groups the words of a line into paragraphs (split on newlines) and sentences
+// (split after end punctuation outside of quotes, and between consecutive quotes)
+func buildParagraphs(words []LineWord) []LineParagraph {
+	paragraphs := make([]LineParagraph, 0)
+	paragraph := LineParagraph{}
+	start := 0
+	depth := 0 // nesting of brackets and quotes
+
+	endSentence := func(end int) {
+		for start < end && strings.TrimSpace(words[start].Surface) == "" {
+			start++ // leading whitespace belongs to no sentence
 		}
-		return story.ID, newWordCount, nil
-	} else {
-		date := time.Now().Unix()
-		result, err := sqldb.Exec(`INSERT INTO stories (lines, title, link, date_added, status, audio, countdown, read_count, date_last_read) 
-				VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
-			linesJson, story.Title, story.Link, date, STORY_INITIAL_STATUS, "", 0, 0, 0)
-		if err != nil {
-			return 0, 0, fmt.Errorf("failure to insert story: " + err.Error())
+		if start < end {
+			paragraph.Sentences = append(paragraph.Sentences, LineSentence{Start: start, End: end})
 		}
-		id, err = result.LastInsertId()
-		if err != nil {
-			return 0, 0, fmt.Errorf("failure to insert story: " + err.Error())
+		start = end
+	}
+	endParagraph := func() {
+		if len(paragraph.Sentences) > 0 {
+			paragraphs = append(paragraphs, paragraph)
+		}
+		paragraph = LineParagraph{}
+		depth = 0
+	}
+	nextStartsQuote := func(i int) bool {
+		for j := i + 1; j < len(words); j++ {
+			surface := strings.TrimSpace(words[j].Surface)
+			if surface != "" {
+				first, _ := utf8.DecodeRuneInString(surface)
+				return strings.ContainsRune(OPENING_BRACKETS, first)
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(words); i++ {
+		surface := words[i].Surface
+		if strings.Contains(surface, "\n") && strings.TrimSpace(surface) == "" {
+			endSentence(i)
+			endParagraph()
+			start = i + 1
+			continue
+		}
+
+		for _, r := range surface {
+			if strings.ContainsRune(OPENING_BRACKETS, r) {
+				depth++
+			} else if strings.ContainsRune(CLOSING_BRACKETS, r) && depth > 0 {
+				depth--
+			}
+		}
+
+		last, _ := utf8.DecodeLastRuneInString(surface)
+		if surface == "" {
+			continue
+		} else if depth == 0 && strings.ContainsRune(SENTENCE_END_PUNCTUATION, last) {
+			endSentence(i + 1)
+		} else if depth == 0 && strings.ContainsRune(CLOSING_BRACKETS, last) && nextStartsQuote(i) {
+			endSentence(i + 1)
 		}
-		return id, newWordCount, nil
 	}
+	endSentence(len(words))
+	endParagraph()
+
+	return paragraphs
 }
 
 func getTokenPOS(token *JpToken, priorToken *JpToken) string {
@@ -312,7 +1004,7 @@ func extractKanji(tokens []*JpToken) ([]string, error) {
 	return kanji, nil
 }
 
-func addWords(tokens []*JpToken, kanjiSet []string, sqldb *sql.DB) ([]LineWord, []LineKanji, int, error) {
+func addWords(tokens []*JpToken, kanjiSet []string, sqldb sqlExecer) ([]LineWord, []LineKanji, int, error) {
 	var reHasKanji = regexp.MustCompile(`[\x{4E00}-\x{9FAF}]`)
 	var reHasKatakana = regexp.MustCompile(`[ア-ン]`)
 	var reHasKana = regexp.MustCompile(`[ア-ンァ-ヴぁ-ゔ]`)
@@ -331,6 +1023,9 @@ func addWords(tokens []*JpToken, kanjiSet []string, sqldb *sql.DB) ([]LineWord,
 		lineWord.Surface = token.Surface
 		lineWord.BaseForm = token.BaseForm
 		lineWord.POS = getTokenPOS(token, priorToken)
+		if token.Reading != "" && token.Reading != "*" && reHasKanji.MatchString(token.Surface) {
+			lineWord.Reading = katakanaToHiragana(token.Reading)
+		}
 
 		category := 0
 
@@ -386,51 +1081,26 @@ func addWords(tokens []*JpToken, kanjiSet []string, sqldb *sql.DB) ([]LineWord,
 		lineWord.ID = id
 	}
 
-	kanjiToInsert := make(map[string]*LineKanji)
-
 	lineKanji := make([]LineKanji, len(kanjiSet))
 	for i, kanji := range kanjiSet {
-		if _, ok := kanjiToInsert[kanji]; ok {
-			continue // early out
-		}
-
-		lk := &lineKanji[i]
-		lk.Character = kanji
-
-		var id int64
-		err := sqldb.QueryRow(`SELECT id FROM words WHERE base_form = $1;`, lk.Character).Scan(&id)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, nil, 0, err
-		}
-		if err == nil {
-			lk.ID = id // kanji already exists
-			continue
-		}
-
-		kanjiToInsert[kanji] = lk
-	}
-
-	for _, lk := range kanjiToInsert {
-		insertResult, err := sqldb.Exec(`INSERT INTO words (base_form, date_marked,
-			date_added, category, rank, drill_count) 
-			VALUES($1, $2, $3, $4, $5, $6);`,
-			lk.Character, 0, unixtime, DRILL_CATEGORY_KANJI, INITIAL_RANK, 0)
+		id, added, err := addKanji(kanji, unixtime, sqldb)
 		if err != nil {
-			return nil, nil, 0, fmt.Errorf("failure to insert kanji: " + err.Error())
+			return nil, nil, 0, err
 		}
-
-		id, err := insertResult.LastInsertId()
-		if err != nil {
-			return nil, nil, 0, fmt.Errorf("failure to get id of inserted kanji: " + err.Error())
+		if added {
+			newWordCount++
 		}
-		newWordCount++
-		lk.ID = id
+		lineKanji[i] = LineKanji{ID: id, Character: kanji}
 	}
 
 	return lineWords, lineKanji, newWordCount, nil
 }
 
 func getDefinitions(baseForm string) []JMDictEntry {
+	// the cache is shared by request handlers and the tokenize worker
+	definitionsCacheMutex.Lock()
+	defer definitionsCacheMutex.Unlock()
+
 	if entries, ok := definitionsCache[baseForm]; ok {
 		return entries
 	}
@@ -450,6 +1120,11 @@ func getDefinitions(baseForm string) []JMDictEntry {
 
 	//fmt.Println("get definitions", baseForm, len(entries))
 
+	// most common first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Commonness > entries[j].Commonness
+	})
+
 	definitionsCache[baseForm] = entries
 	return entries
 }
@@ -553,7 +1228,7 @@ func GetStoriesList(response http.ResponseWriter, request *http.Request) {
 	}
 	defer sqldb.Close()
 
-	rows, err := sqldb.Query(`SELECT id, title, link, status, date_added, countdown, read_count, date_last_read FROM stories;`)
+	rows, err := sqldb.Query(`SELECT id, title, link, status, date_added, countdown, read_count, date_last_read, is_tokenized FROM stories;`)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
 		response.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
@@ -565,7 +1240,7 @@ func GetStoriesList(response http.ResponseWriter, request *http.Request) {
 	for rows.Next() {
 		var story Story
 		if err := rows.Scan(&story.ID, &story.Title, &story.Link, &story.Status,
-			&story.DateAdded, &story.Countdown, &story.ReadCount, &story.DateLastRead); err != nil {
+			&story.DateAdded, &story.Countdown, &story.ReadCount, &story.DateLastRead, &story.IsTokenized); err != nil {
 			response.WriteHeader(http.StatusInternalServerError)
 			response.Write([]byte(`{ "message": "` + "failure to read story list: " + err.Error() + `"}`))
 			return
@@ -621,12 +1296,12 @@ func GetStory(w http.ResponseWriter, r *http.Request) {
 }
 
 func getStory(id int64, sqldb *sql.DB) (Story, error) {
-	row := sqldb.QueryRow(`SELECT title, link, lines, date_added, audio, countdown, read_count, date_last_read FROM stories WHERE id = $1;`, id)
+	row := sqldb.QueryRow(`SELECT title, link, lines, date_added, audio, status, countdown, read_count, date_last_read, is_tokenized FROM stories WHERE id = $1;`, id)
 
 	var linesJSON string
 	story := Story{ID: id}
 	if err := row.Scan(&story.Title, &story.Link, &linesJSON, &story.DateAdded,
-		&story.Audio, &story.Countdown, &story.ReadCount, &story.DateLastRead); err != nil {
+		&story.Audio, &story.Status, &story.Countdown, &story.ReadCount, &story.DateLastRead, &story.IsTokenized); err != nil {
 		return Story{}, fmt.Errorf("failure to scan story row: " + err.Error())
 	}
 
@@ -635,29 +1310,45 @@ func getStory(id int64, sqldb *sql.DB) (Story, error) {
 		return Story{}, fmt.Errorf("failure to unmarshall story lines: " + err.Error())
 	}
 
-	wordInfo := make(map[string]WordInfo)
-
-	for _, line := range story.Lines {
-		for _, word := range line.Words {
-			wordInfo[word.BaseForm] = WordInfo{
-				Definitions: getDefinitions(word.BaseForm),
-			}
+	// stories tokenized before paragraphs were recorded
+	for i := range story.Lines {
+		if story.Lines[i].Paragraphs == nil {
+			story.Lines[i].Paragraphs = buildParagraphs(story.Lines[i].Words)
 		}
 	}
 
-	story.WordInfo = wordInfo
+	_, dueDate, err := getDueDateFunc(sqldb)
+	if err != nil {
+		return Story{}, err
+	}
+	notes, err := getWordNotes(sqldb)
+	if err != nil {
+		return Story{}, err
+	}
+
+	story.WordInfo = make(map[string]WordInfo)
+	for _, line := range story.Lines {
+		for _, lineWord := range line.Words {
+			if _, ok := story.WordInfo[lineWord.BaseForm]; ok {
+				continue
+			}
 
-	for baseForm := range story.WordInfo {
-		wordInfo := story.WordInfo[baseForm]
+			word := DrillWord{BaseForm: lineWord.BaseForm}
+			row := sqldb.QueryRow(`SELECT id, rank, date_marked FROM words WHERE base_form = $1;`, lineWord.BaseForm)
 
-		row := sqldb.QueryRow(`SELECT rank, date_marked FROM words WHERE base_form = $1;`, baseForm)
+			err = row.Scan(&word.ID, &word.Rank, &word.DateMarked)
+			if err != nil && err != sql.ErrNoRows {
+				return Story{}, fmt.Errorf("failure to get word info: " + err.Error())
+			}
+			if err == sql.ErrNoRows {
+				// not a vocab word, but the definitions may still help
+				story.WordInfo[lineWord.BaseForm] = WordInfo{Definitions: getDefinitions(lineWord.BaseForm)}
+				continue
+			}
 
-		err = row.Scan(&wordInfo.Rank, &wordInfo.DateMarked)
-		if err != nil && err != sql.ErrNoRows {
-			return Story{}, fmt.Errorf("failure to get word info: " + err.Error())
+			word.Due = dueDate(word)
+			story.WordInfo[lineWord.BaseForm] = getWordInfo(word, notes[word.ID])
 		}
-
-		story.WordInfo[baseForm] = wordInfo
 	}
 
 	return story, nil
@@ -681,6 +1372,12 @@ func UpdateStoryCounts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if story.Countdown < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "story countdown cannot be negative" + `"}`))
+		return
+	}
+
 	sqldb, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -705,8 +1402,9 @@ func UpdateStoryCounts(w http.ResponseWriter, r *http.Request) {
 	}
 	rows.Close()
 
-	_, err = sqldb.Exec(`UPDATE stories SET countdown = $1, read_count = $2, date_last_read = $3 WHERE id = $4;`,
-		story.Countdown, story.ReadCount, story.DateLastRead, story.ID)
+	// the read count and date last read are only changed by logging a read (see addLogEvent)
+	_, err = sqldb.Exec(`UPDATE stories SET countdown = $1 WHERE id = $2;`,
+		story.Countdown, story.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{ "message": "` + "failure to update story: " + err.Error() + `"}`))
@@ -716,6 +1414,181 @@ func UpdateStoryCounts(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(bson.M{"status": "success"})
 }
 
+func UpdateStoryStatus(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var story Story
+	err = json.NewDecoder(r.Body).Decode(&story)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	var oldStatus int
+	row := sqldb.QueryRow(`SELECT status FROM stories WHERE id = $1;`, story.ID)
+	if err := row.Scan(&oldStatus); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + "story with ID does not exist: " + strconv.FormatInt(story.ID, 10) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to get story: " + err.Error() + `"}`))
+		return
+	}
+
+	if !isValidStatusTransition(oldStatus, story.Status) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + fmt.Sprintf("cannot change story status from %d to %d", oldStatus, story.Status) + `"}`))
+		return
+	}
+
+	story, err = setStoryStatus(story.ID, oldStatus, story.Status, story.Countdown, sqldb)
+	if errors.Is(err, errStatusChanged) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(story)
+}
+
+func isValidStatusTransition(oldStatus int, newStatus int) bool {
+	for _, status := range storyStatusTransitions[oldStatus] {
+		if status == newStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// changes the story's status and records the change in the status history, failing with
+// errStatusChanged unless the story's status is still oldStatus; a story made current gets a countdown (the requested one or else the default),
+// and an archived story's countdown is cleared
+func setStoryStatus(storyID int64, oldStatus int, newStatus int, countdown int, sqldb *sql.DB) (Story, error) {
+	switch newStatus {
+	case STORY_STATUS_CURRENT:
+		if countdown <= 0 {
+			countdown = STORY_DEFAULT_COUNTDOWN
+		}
+	case STORY_STATUS_ARCHIVE:
+		countdown = 0
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return Story{}, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE stories SET status = $1, countdown = $2 WHERE id = $3 AND status = $4;`,
+		newStatus, countdown, storyID, oldStatus)
+	if err != nil {
+		return Story{}, fmt.Errorf("failure to update story status: " + err.Error())
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return Story{}, fmt.Errorf("failure to update story status: " + err.Error())
+	} else if affected == 0 {
+		return Story{}, fmt.Errorf("%w: expected status %d", errStatusChanged, oldStatus)
+	}
+
+	_, err = tx.Exec(`INSERT INTO story_status_changes (story, old_status, new_status, date) 
+			VALUES($1, $2, $3, $4);`,
+		storyID, oldStatus, newStatus, time.Now().Unix())
+	if err != nil {
+		return Story{}, fmt.Errorf("failure to record story status change: " + err.Error())
+	}
+
+	story := Story{ID: storyID}
+	row := tx.QueryRow(`SELECT title, status, countdown, read_count, date_last_read FROM stories WHERE id = $1;`, storyID)
+	if err := row.Scan(&story.Title, &story.Status, &story.Countdown, &story.ReadCount, &story.DateLastRead); err != nil {
+		return Story{}, fmt.Errorf("failure to read updated story: " + err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Story{}, fmt.Errorf("failure to commit story status change: " + err.Error())
+	}
+
+	return story, nil
+}
+
+func GetStoryStatusHistory(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	changes, err := getStoryStatusHistory(int64(id), sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(changes)
+}
+
+func getStoryStatusHistory(storyID int64, sqldb *sql.DB) ([]StoryStatusChange, error) {
+	rows, err := sqldb.Query(`SELECT id, story, old_status, new_status, date FROM story_status_changes 
+		WHERE story = $1 ORDER BY date, id;`, storyID)
+	if err != nil {
+		return nil, fmt.Errorf("failure to get story status history: " + err.Error())
+	}
+	defer rows.Close()
+
+	changes := make([]StoryStatusChange, 0)
+	for rows.Next() {
+		var change StoryStatusChange
+		if err := rows.Scan(&change.ID, &change.StoryID, &change.OldStatus, &change.NewStatus, &change.Date); err != nil {
+			return nil, fmt.Errorf("failure to scan story status change: " + err.Error())
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
 // remove a line and combine its content with the previous line
 func ConsolidateLine(w http.ResponseWriter, r *http.Request) {
 	dbPath, redirect, err := GetUserDb(w, r)
@@ -794,6 +1667,8 @@ func ConsolidateLine(w http.ResponseWriter, r *http.Request) {
 		i++
 	}
 
+	prevLine.Paragraphs = buildParagraphs(prevLine.Words)
+
 	// remove the line
 	lines = append(lines[:idx], lines[idx+1:]...)
 
@@ -877,47 +1752,8 @@ func SplitLine(w http.ResponseWriter, r *http.Request) {
 		timestamp = origLine.Timestamp
 	}
 
-	newLine := Line{
-		Words:     origLine.Words[splitLine.WordIdx:],
-		Timestamp: timestamp,
-	}
-	origLine.Words = origLine.Words[:splitLine.WordIdx]
-
-	kanjiMap := make(map[string]LineKanji)
-	for _, v := range origLine.Kanji {
-		kanjiMap[v.Character] = v
-	}
-	for _, v := range newLine.Kanji {
-		kanjiMap[v.Character] = v
-	}
-
-	origKanjiMap := make(map[string]bool)
-	for _, word := range origLine.Words {
-		for _, rune := range word.Surface {
-			s := string(rune)
-			if _, ok := kanjiMap[s]; ok {
-				origKanjiMap[string(rune)] = true
-			}
-		}
-	}
-	newKanjiMap := make(map[string]bool)
-	for _, word := range newLine.Words {
-		for _, rune := range word.Surface {
-			s := string(rune)
-			if _, ok := kanjiMap[s]; ok {
-				newKanjiMap[string(rune)] = true
-			}
-		}
-	}
-
-	origLine.Kanji = make([]LineKanji, 0)
-	for ch := range origKanjiMap {
-		origLine.Kanji = append(origLine.Kanji, kanjiMap[ch])
-	}
-	newLine.Kanji = make([]LineKanji, 0)
-	for ch := range newKanjiMap {
-		newLine.Kanji = append(newLine.Kanji, kanjiMap[ch])
-	}
+	var newLine Line
+	*origLine, newLine = splitLineAt(*origLine, splitLine.WordIdx, timestamp)
 
 	// insert the line
 	lines = append(lines[:idx+1], lines[idx:]...)
@@ -1016,6 +1852,52 @@ func SetTimestamp(w http.ResponseWriter, r *http.Request) {
 	w.Write(linesBytes)
 }
 
+// splits the line before the word at wordIdx; the second line gets the timestamp
+// and each line keeps only the kanji found in its own words
+func splitLineAt(line Line, wordIdx int, timestamp string) (Line, Line) {
+	origLine := Line{
+		Words:     append([]LineWord{}, line.Words[:wordIdx]...),
+		Timestamp: line.Timestamp,
+		Marked:    line.Marked,
+	}
+	newLine := Line{
+		Words:     append([]LineWord{}, line.Words[wordIdx:]...),
+		Timestamp: timestamp,
+	}
+
+	kanjiMap := make(map[string]LineKanji)
+	for _, v := range line.Kanji {
+		kanjiMap[v.Character] = v
+	}
+
+	origLine.Kanji = getWordsKanji(origLine.Words, kanjiMap)
+	newLine.Kanji = getWordsKanji(newLine.Words, kanjiMap)
+
+	origLine.Paragraphs = buildParagraphs(origLine.Words)
+	newLine.Paragraphs = buildParagraphs(newLine.Words)
+
+	return origLine, newLine
+}
+
+// the kanji of kanjiMap which appear in the surfaces of the words
+func getWordsKanji(words []LineWord, kanjiMap map[string]LineKanji) []LineKanji {
+	found := make(map[string]bool)
+	for _, word := range words {
+		for _, rune := range word.Surface {
+			s := string(rune)
+			if _, ok := kanjiMap[s]; ok {
+				found[s] = true
+			}
+		}
+	}
+
+	kanji := make([]LineKanji, 0)
+	for ch := range found {
+		kanji = append(kanji, kanjiMap[ch])
+	}
+	return kanji
+}
+
 func secondsToTimestamp(seconds float64) string {
 	minutes := math.Floor(seconds / 60)
 	seconds -= minutes * 60
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const SUBTITLE_FORMAT_SRT = "srt"
+const SUBTITLE_FORMAT_VTT = "vtt"
+
+// merged cues stop growing past this many seconds so a line never covers a whole scene
+const SUBTITLE_MAX_MERGED_DURATION = 15
+
+// a cue ending in one of these continues in the next cue
+const SUBTITLE_CONTINUATION_PUNCTUATION = "、，,・→"
+
+// matches "hh:mm:ss,mmm" (srt) and "hh:mm:ss.mmm" or "mm:ss.mmm" (vtt)
+var subtitleTimeRegex = regexp.MustCompile(`^(?:(\d+):)?(\d{1,2}):(\d{1,2})(?:[.,](\d{1,3}))?$`)
+
+// html-like tags (<i>, <c.yellow>, <00:01.000>) and ass override blocks ({\an8})
+var subtitleTagRegex = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+
+// create a story from the cues of a .srt or .vtt file; like CreateStory, the lines are tokenized in the background
+func ImportSubtitles(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var subtitleImport SubtitleImportRequest
+	err = json.NewDecoder(r.Body).Decode(&subtitleImport)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	cues, err := parseSubtitles(subtitleImport.Subtitles, subtitleImport.Format)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	if len(cues) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + "subtitles contain no cues" + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	story := Story{
+		Title:   subtitleImport.Title,
+		Link:    subtitleImport.Link,
+		Content: cuesToContent(mergeSubtitleCues(cues)),
+	}
+
+	id, err := insertUntokenizedStory(story, sqldb)
+	if err != nil {
+		if errors.Is(err, errDuplicateTitle) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	enqueueTokenizeJob(dbPath, id)
+
+	json.NewEncoder(w).Encode(Story{ID: id, Title: story.Title, Link: story.Link, IsTokenized: false})
+}
+
+// format is "srt" or "vtt"; if empty, it is guessed from the header
+func parseSubtitles(subtitles string, format string) ([]SubtitleCue, error) {
+	subtitles = strings.TrimPrefix(subtitles, "\uFEFF")
+	subtitles = strings.ReplaceAll(subtitles, "\r\n", "\n")
+	subtitles = strings.ReplaceAll(subtitles, "\r", "\n")
+
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if format == "" {
+		format = SUBTITLE_FORMAT_SRT
+		if strings.HasPrefix(strings.TrimSpace(subtitles), "WEBVTT") {
+			format = SUBTITLE_FORMAT_VTT
+		}
+	}
+	if format != SUBTITLE_FORMAT_SRT && format != SUBTITLE_FORMAT_VTT {
+		return nil, fmt.Errorf("unsupported subtitle format: " + format)
+	}
+
+	blocks := regexp.MustCompile(`\n\s*\n`).Split(strings.TrimSpace(subtitles), -1)
+
+	cues := make([]SubtitleCue, 0, len(blocks))
+	for _, block := range blocks {
+		lines := strings.Split(block, "\n")
+
+		// the timing line follows an optional cue number (srt) or identifier (vtt);
+		// blocks without one are the vtt header, NOTE, STYLE and REGION blocks
+		timingIdx := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timingIdx = i
+				break
+			}
+		}
+		if timingIdx == -1 {
+			continue
+		}
+
+		start, end, err := parseCueTiming(lines[timingIdx])
+		if err != nil {
+			return nil, err
+		}
+
+		text := cleanCueText(lines[timingIdx+1:])
+		if text == "" {
+			continue
+		}
+
+		cues = append(cues, SubtitleCue{Start: start, End: end, Text: text})
+	}
+
+	return cues, nil
+}
+
+// e.g. "00:01:02,500 --> 00:01:04,000" or "01:02.500 --> 01:04.000 align:start"
+func parseCueTiming(timing string) (start float64, end float64, err error) {
+	parts := strings.SplitN(timing, "-->", 2)
+	start, err = parseSubtitleTime(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// vtt cue settings follow the end time
+	endFields := strings.Fields(parts[1])
+	if len(endFields) == 0 {
+		return 0, 0, fmt.Errorf("cue timing missing end time: " + timing)
+	}
+	end, err = parseSubtitleTime(endFields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+func parseSubtitleTime(timestamp string) (float64, error) {
+	matches := subtitleTimeRegex.FindStringSubmatch(timestamp)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid subtitle timestamp: " + timestamp)
+	}
+
+	hours, _ := strconv.Atoi(matches[1]) // empty when there's no hours field
+	minutes, _ := strconv.Atoi(matches[2])
+	seconds, _ := strconv.Atoi(matches[3])
+	millis := 0
+	if matches[4] != "" {
+		// pad so that ".5" is 500 ms rather than 5 ms
+		millis, _ = strconv.Atoi((matches[4] + "00")[:3])
+	}
+
+	return float64(hours*60*60+minutes*60+seconds) + float64(millis)/1000, nil
+}
+
+// joins the cue's lines (see cueJoiner), dropping formatting tags and entities
+func cleanCueText(lines []string) string {
+	text := ""
+	for _, line := range lines {
+		line = subtitleTagRegex.ReplaceAllString(line, "")
+		line = html.UnescapeString(line)
+		line = strings.TrimSpace(strings.ReplaceAll(line, "\u00a0", " "))
+		if line == "" {
+			continue
+		}
+		if text != "" {
+			text += cueJoiner(text, line)
+		}
+		text += line
+	}
+	return text
+}
+
+// merges each cue that was split mid-sentence into the cue before it
+func mergeSubtitleCues(cues []SubtitleCue) []SubtitleCue {
+	merged := make([]SubtitleCue, 0, len(cues))
+	for _, cue := range cues {
+		if len(merged) > 0 {
+			prev := &merged[len(merged)-1]
+			if isCueContinued(prev.Text, cue.Text) && cue.End-prev.Start <= SUBTITLE_MAX_MERGED_DURATION {
+				prev.Text += cueJoiner(prev.Text, cue.Text) + cue.Text
+				prev.End = cue.End
+				continue
+			}
+		}
+		merged = append(merged, cue)
+	}
+	return merged
+}
+
+// the sentence continues if the cue ends in a comma-like mark, or if
+// (in latin-script subtitles) the next cue starts in lowercase
+func isCueContinued(text string, nextText string) bool {
+	last, _ := utf8.DecodeLastRuneInString(text)
+	if strings.ContainsRune(SUBTITLE_CONTINUATION_PUNCTUATION, last) {
+		return true
+	}
+	if strings.ContainsRune(SENTENCE_END_PUNCTUATION, last) || strings.ContainsRune(CLOSING_BRACKETS, last) {
+		return false
+	}
+	first, _ := utf8.DecodeRuneInString(nextText)
+	return unicode.IsLower(first)
+}
+
+// japanese text runs together but latin words need a space
+func cueJoiner(text string, nextText string) string {
+	last, _ := utf8.DecodeLastRuneInString(text)
+	first, _ := utf8.DecodeRuneInString(nextText)
+	if last < utf8.RuneSelf && first < utf8.RuneSelf {
+		return " "
+	}
+	return ""
+}
+
+// content in the timestamped form splitStoryContent expects
+func cuesToContent(cues []SubtitleCue) string {
+	var sb strings.Builder
+	for _, cue := range cues {
+		sb.WriteString(formatTimestamp(cue.Start) + "\n")
+		sb.WriteString(cue.Text + "\n")
+	}
+	return sb.String()
+}
+
+// hours are folded into the minutes because line timestamps are "m:ss" (with optional milliseconds)
+func formatTimestamp(seconds float64) string {
+	totalMillis := int64(math.Round(seconds * 1000))
+	minutes := totalMillis / (60 * 1000)
+	wholeSeconds := (totalMillis / 1000) % 60
+	millis := totalMillis % 1000
+
+	s := fmt.Sprintf("%d:%02d", minutes, wholeSeconds)
+	if millis > 0 {
+		s += fmt.Sprintf(".%03d", millis)
+	}
+	return s
+}
@@ -17,28 +17,55 @@ type Story struct {
 	Countdown    int                 `json:"countdown"`
 	DateLastRead int64               `json:"date_last_read"`
 	DateAdded    int64               `json:"date_added,omitempty"`
+	IsTokenized  bool                `json:"is_tokenized"`
 	WordInfo     map[string]WordInfo `json:"word_info,omitempty"`
 }
 
 type WordInfo struct {
-	Rank        int           `json:"rank"`
-	Definitions []JMDictEntry `json:"definitions,omitempty"`
-	DateMarked  int64         `json:"date_marked"`
+	Rank         int           `json:"rank"`
+	Definitions  []JMDictEntry `json:"definitions,omitempty"` // the primary entry first
+	DateMarked   int64         `json:"date_marked"`
+	Due          int64         `json:"due"` // under the user's scheduler and cooldowns
+	Note         string        `json:"note,omitempty"`
+	Mnemonic     string        `json:"mnemonic,omitempty"`
+	Gloss        string        `json:"gloss,omitempty"`         // the user's preferred gloss
+	PrimaryEntry string        `json:"primary_entry,omitempty"` // see entryKey
+}
+
+// the user's own notes on a word
+type WordNote struct {
+	BaseForm     string `json:"base_form"`
+	Note         string `json:"note"`
+	Mnemonic     string `json:"mnemonic"`
+	Gloss        string `json:"gloss"`
+	PrimaryEntry string `json:"primary_entry"` // see entryKey
 }
 
 type Line struct {
 	Words     []LineWord `json:"words,omitempty"`
 	Timestamp string     `json:"timestamp,omitempty"`
 	//Content   string      `json:"content,omitempty"`
-	Kanji  []LineKanji `json:"kanji,omitempty"`
-	Marked bool        `json:"marked"`
+	Kanji      []LineKanji     `json:"kanji,omitempty"`
+	Marked     bool            `json:"marked"`
+	Paragraphs []LineParagraph `json:"paragraphs,omitempty"`
+}
+
+type LineParagraph struct {
+	Sentences []LineSentence `json:"sentences,omitempty"`
+}
+
+// a range of Line.Words
+type LineSentence struct {
+	Start int `json:"start"`
+	End   int `json:"end"` // exclusive
 }
 
 type LineWord struct {
 	ID       int64  `json:"id,omitempty"`
 	BaseForm string `json:"baseform,omitempty"`
 	Surface  string `json:"surface"`
-	POS      string `json:"pos,omitempty"` // highlight color
+	Reading  string `json:"reading,omitempty"` // hiragana, only for surfaces with kanji
+	POS      string `json:"pos,omitempty"`     // highlight color
 	Category int    `json:"Category,omitempty"`
 }
 
@@ -47,6 +74,23 @@ type LineKanji struct {
 	Character string `json:"character,omitempty"`
 }
 
+type StoryStatusChange struct {
+	ID        int64 `json:"id,omitempty"`
+	StoryID   int64 `json:"story_id,omitempty"`
+	OldStatus int   `json:"old_status"`
+	NewStatus int   `json:"new_status"`
+	Date      int64 `json:"date"`
+}
+
+type TokenizeStatus struct {
+	StoryID     int64  `json:"story_id"`
+	State       string `json:"state"` // queued, running, failed or done
+	LinesDone   int    `json:"lines_done"`
+	LinesTotal  int    `json:"lines_total"`
+	IsTokenized bool   `json:"is_tokenized"`
+	Error       string `json:"error,omitempty"`
+}
+
 type LogEvent struct {
 	ID      int64  `json:"id,omitempty"`
 	StoryID int64  `json:"story_id,omitempty"`
@@ -78,12 +122,62 @@ type SetLineMarkRequest struct {
 	Marked  bool  `json:"marked"`
 }
 
+type SubtitleImportRequest struct {
+	Title     string `json:"title,omitempty"`
+	Link      string `json:"link,omitempty"`
+	Format    string `json:"format,omitempty"` // "srt" or "vtt"; guessed if empty
+	Subtitles string `json:"subtitles,omitempty"`
+}
+
+type SubtitleCue struct {
+	Start float64 // seconds
+	End   float64 // seconds
+	Text  string
+}
+
+// nil fields are left unchanged
+type EditStoryRequest struct {
+	StoryID int64   `json:"story_id,omitempty"`
+	Title   *string `json:"title,omitempty"`
+	Link    *string `json:"link,omitempty"`
+	Content *string `json:"content,omitempty"`
+}
+
+type DeleteStoryRequest struct {
+	StoryID     int64 `json:"story_id,omitempty"`
+	RemoveWords bool  `json:"remove_words"` // also remove words and kanji found in no other story
+	DryRun      bool  `json:"dry_run"`      // only report what would be removed
+}
+
+type DeleteStoryResult struct {
+	StoryID      int64    `json:"story_id,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	DryRun       bool     `json:"dry_run"`
+	RemovedWords []string `json:"removed_words"`
+	KeptWords    []string `json:"kept_words"` // unique to the story but already drilled
+	RemovedKanji []string `json:"removed_kanji"`
+	KeptKanji    []string `json:"kept_kanji"` // unique to the story but already drilled or encountered
+}
+
 type StoryList struct {
 	Stories []Story `json:"stories,omitempty"`
 }
 
+// zero values of the filters (and a category mask of -1) include every word
 type DrillRequest struct {
-	StoryIds []int64 `json:"story_ids,omitempty"`
+	StoryIds     []int64 `json:"story_ids,omitempty"`
+	Filter       string  `json:"filter,omitempty"` // DRILL_FILTER_*
+	CategoryMask int     `json:"category_mask,omitempty"`
+	MinRank      int     `json:"min_rank,omitempty"`
+	MaxRank      int     `json:"max_rank,omitempty"`
+	Limit        int     `json:"limit,omitempty"`
+}
+
+type DrillWords struct {
+	Words                   []DrillWord
+	CountsByRank            []int // indexed by rank
+	OffCooldownCountsByRank []int
+	Total                   int
 }
 
 type EnqueueRequest struct {
@@ -91,6 +185,14 @@ type EnqueueRequest struct {
 	Count   int   `json:"count,omitempty"`
 }
 
+type QueueReorderRequest struct {
+	IDs []int64 `json:"ids,omitempty"`
+}
+
+type DequeueRequest struct {
+	ID int64 `json:"id,omitempty"`
+}
+
 type EnqueuedStory struct {
 	Date    int    `json:"date"`
 	ID      int64  `json:"id,omitempty"`
@@ -105,12 +207,173 @@ type DrillWord struct {
 	Rank       int    `json:"rank"`
 	DateMarked int64  `json:"date_marked"`
 	Category   int    `json:"category"`
+	DrillCount int    `json:"drill_count"`
+	Due        int64  `json:"due"` // when the user's scheduler next wants the word drilled
+	Lapses     int    `json:"lapses"`
+	Leech      bool   `json:"leech"`
+}
+
+type DrillKanji struct {
+	ID             int64  `json:"id,omitempty"`
+	Character      string `json:"character"`
+	Rank           int    `json:"rank"`
+	DateMarked     int64  `json:"date_marked"`
+	DrillCount     int    `json:"drill_count"`     // reviews of the kanji itself
+	EncounterCount int    `json:"encounter_count"` // reviews of words containing the kanji
+	Due            int64  `json:"due"`
+}
+
+type KanjiDrillResult struct {
+	Kanji                   []DrillKanji `json:"kanji"`
+	CountsByRank            []int        `json:"countsByRank"` // indexed by rank
+	OffCooldownCountsByRank []int        `json:"offCooldownCountsByRank"`
+	Total                   int          `json:"total"`
+}
+
+type ClozeRequest struct {
+	StoryIds     []int64 `json:"story_ids,omitempty"` // selects the words; the sentences come from every story
+	CategoryMask int     `json:"category_mask,omitempty"`
+	MinRank      int     `json:"min_rank,omitempty"`
+	MaxRank      int     `json:"max_rank,omitempty"`
+	Limit        int     `json:"limit,omitempty"`
+	MaxContexts  int     `json:"max_contexts,omitempty"` // sentences per word
+}
+
+type ClozeDrillResult struct {
+	Clozes      []Cloze             `json:"clozes"`
+	WordInfoMap map[string]WordInfo `json:"wordInfoMap"`
+}
+
+type Cloze struct {
+	Word     DrillWord      `json:"word"`
+	Contexts []ClozeContext `json:"contexts"`
+}
+
+type ClozeContext struct {
+	StoryID    int64    `json:"story_id"`
+	StoryTitle string   `json:"story_title"`
+	Timestamp  string   `json:"timestamp"`
+	LineIdx    int      `json:"line_idx"`
+	Sentence   string   `json:"sentence"` // with CLOZE_BLANK in place of each occurrence of the word
+	Answers    []string `json:"answers"`  // the blanked surfaces, in order
+}
+
+type DrillStats struct {
+	TotalWords       int            `json:"total_words"`
+	TotalKanji       int            `json:"total_kanji"`
+	CountsByRank     []int          `json:"counts_by_rank"`     // indexed by rank
+	CountsByCategory map[string]int `json:"counts_by_category"` // a word may be counted in more than one category
+	WordsAddedByWeek []WeekCount    `json:"words_added_by_week"`
+	Suspended        int            `json:"suspended"`
+	Overdue          int            `json:"overdue"`
+	DueForecast      []int          `json:"due_forecast"` // words coming due on each of the next days, starting today
+	AccuracyByRank   []RankAccuracy `json:"accuracy_by_rank"`
+}
+
+type WeekCount struct {
+	WeekStart int64 `json:"week_start"`
+	Count     int   `json:"count"`
+}
+
+type RankAccuracy struct {
+	Rank     int     `json:"rank"`
+	Correct  int     `json:"correct"`
+	Total    int     `json:"total"`
+	Accuracy float64 `json:"accuracy"`
+}
+
+type KanjiUpdate struct {
+	Character      string `json:"character"`
+	Rank           int    `json:"rank"`
+	DateMarked     int64  `json:"date_marked"`
+	Answer         string `json:"answer,omitempty"` // "correct" or "wrong"; empty if the kanji wasn't drilled
+	DrillCount     int    `json:"drill_count"`
+	EncounterCount int    `json:"encounter_count"`
+	Due            int64  `json:"due"`
 }
 
 type WordUpdate struct {
 	BaseForm   string `json:"base_form"`
 	Rank       int    `json:"rank"`
 	DateMarked int64  `json:"date_marked"`
+	Answer     string `json:"answer,omitempty"` // "correct" or "wrong"; empty if the word wasn't drilled
+	DrillCount int    `json:"drill_count"`
+	Due        int64  `json:"due"`
+	Lapses     int    `json:"lapses"`
+	Leech      bool   `json:"leech"`
+	Suspended  bool   `json:"suspended"`
+}
+
+type Leech struct {
+	BaseForm   string  `json:"base_form"`
+	Rank       int     `json:"rank"`
+	DateMarked int64   `json:"date_marked"`
+	DrillCount int     `json:"drill_count"`
+	Lapses     int     `json:"lapses"`
+	Suspended  bool    `json:"suspended"`
+	Accuracy   float64 `json:"accuracy"` // over all the word's reviews
+}
+
+type LeechUpdate struct {
+	BaseForm   string `json:"base_form"`
+	Suspended  bool   `json:"suspended"`
+	ClearLeech bool   `json:"clear_leech,omitempty"`
+}
+
+type WordBatchUpdate struct {
+	Words []WordUpdate `json:"words"`
+}
+
+type WordBatchResult struct {
+	Results []WordUpdateResult `json:"results"` // in the order of the updates
+	Updated int                `json:"updated"`
+	Failed  int                `json:"failed"`
+}
+
+type WordUpdateResult struct {
+	Index    int         `json:"index"`
+	BaseForm string      `json:"base_form"`
+	Word     *WordUpdate `json:"word,omitempty"`  // the word as updated; nil if the update failed
+	Error    string      `json:"error,omitempty"` // why the update failed
+}
+
+// a word's state under one scheduler; each scheduler uses only some of the fields
+type WordSchedule struct {
+	WordID      int64   `json:"word_id"`
+	Scheduler   string  `json:"scheduler"`
+	Ease        float64 `json:"ease,omitempty"`       // SM-2
+	Interval    float64 `json:"interval,omitempty"`   // days
+	Stability   float64 `json:"stability,omitempty"`  // FSRS, in days
+	Difficulty  float64 `json:"difficulty,omitempty"` // FSRS, 1 to 10
+	Repetitions int     `json:"repetitions"`          // consecutive correct answers
+	Due         int64   `json:"due"`
+	LastReview  int64   `json:"last_review"`
+}
+
+type UserSettings struct {
+	Scheduler      string  `json:"scheduler"`
+	RankCount      int     `json:"rank_count"`
+	Cooldowns      []int64 `json:"cooldowns"`       // seconds, for ranks 1 through RankCount
+	LeechThreshold int     `json:"leech_threshold"` // lapses after which a word is a leech
+	SuspendLeeches *bool   `json:"suspend_leeches"` // nil in an update leaves the setting unchanged
+}
+
+type WordReview struct {
+	ID      int64 `json:"id,omitempty"`
+	WordID  int64 `json:"word_id,omitempty"`
+	Date    int64 `json:"date"`
+	Correct bool  `json:"correct"`
+	OldRank int   `json:"old_rank"`
+	NewRank int   `json:"new_rank"`
+}
+
+type WordReviewHistory struct {
+	BaseForm   string       `json:"base_form"`
+	DrillCount int          `json:"drill_count"`
+	Correct    int          `json:"correct"`
+	Wrong      int          `json:"wrong"`
+	Accuracy   float64      `json:"accuracy"` // fraction of all reviews answered correctly
+	Reviews    []WordReview `json:"reviews"`  // most recent first
 }
 
 type JpToken struct {
@@ -145,7 +408,37 @@ type Word struct {
 }
 
 type WordSearch struct {
-	Word string `json:"word,omitempty" bson:"word,omitempty"`
+	Word   string `json:"word,omitempty" bson:"word,omitempty"`
+	Offset int    `json:"offset,omitempty" bson:"offset,omitempty"` // into the start matches followed by the mid matches
+	Limit  int    `json:"limit,omitempty" bson:"limit,omitempty"`   // WORD_SEARCH_DEFAULT_LIMIT if 0
+}
+
+// a page of the entries starting with the searched word, then of those containing it elsewhere
+type WordSearchResult struct {
+	EntriesStart []JMDictEntry    `json:"entries_start"`
+	CountStart   int              `json:"count_start"`
+	EntriesMid   []JMDictEntry    `json:"entries_mid"`
+	CountMid     int              `json:"count_mid"`
+	Kanji        []KanjiCharacter `json:"kanji"`
+}
+
+type GlossSearch struct {
+	Query  string `json:"query"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"` // GLOSS_SEARCH_DEFAULT_LIMIT if 0
+}
+
+type GlossSearchResult struct {
+	Matches []GlossMatch `json:"matches"`
+	Count   int          `json:"count"` // of all the matches, not just this page
+}
+
+type GlossMatch struct {
+	Entry     JMDictEntry `json:"entry"`
+	Match     string      `json:"match"`                // "whole", "start" or "inside": where the searched words are in the gloss
+	Gloss     string      `json:"gloss"`                // the entry's best matching gloss
+	KnownWord string      `json:"known_word,omitempty"` // the entry's spelling or reading in the user's words
+	Rank      int         `json:"rank,omitempty"`       // of the known word
 }
 
 // JMDict xml format
@@ -157,12 +450,13 @@ type JMDict struct {
 type JMDictEntry struct {
 	//XMLName               *xml.Name          `xml:"entry" bson:"xmlname,omitempty" json:"xmlname,omitempty"`
 	//ID                    primitive.ObjectID `bson:"_id, omitempty"`
-	//Ent_seq               string             `xml:"ent_seq" bson:"sequence_number,omitempty" json:"sequence_number,omitempty"`
+	Ent_seq               string        `xml:"ent_seq" bson:"sequence_number,omitempty" json:"sequence_number,omitempty"`
 	Senses                []JMDictSense `xml:"sense" bson:"senses,omitempty" json:"senses,omitempty"`
 	Readings              []JMDictR_ele `xml:"r_ele" bson:"readings,omitempty" json:"readings,omitempty"`
 	KanjiSpellings        []JMDictK_ele `xml:"k_ele" bson:"kanji_spellings,omitempty" json:"kanji_spellings,omitempty"`
 	ShortestKanjiSpelling int
 	ShortestReading       int
+	Commonness            int `bson:"-" json:"commonness,omitempty"` // from the priorities of the spellings and readings
 }
 
 type JMDictSense struct {
@@ -196,15 +490,15 @@ type JMDictR_ele struct {
 	gairaigo which can be in kanji or katakana, etc. */
 	//Re_restr []string `xml:"re_restr" bson:"restrictions,omitempty" json:"restrictions,omitempty"` // reading only applies to a subset of the keb elements in the entry
 	Re_inf []string `xml:"re_inf" bson:"information,omitempty" json:"information,omitempty"` // denotes orthography, e.g. okurigana irregularity
-	//Re_pri   []string `xml:"re_pri" bson:"priority,omitempty" json:"priority,omitempty"`           // relative priority (see schema)
-	Pitch string `bson:"pitch,omitempty" json:"pitch,omitempty"`
+	Re_pri []string `xml:"re_pri" bson:"priority,omitempty" json:"priority,omitempty"`       // relative priority (see schema)
+	Pitch  string   `bson:"pitch,omitempty" json:"pitch,omitempty"`                          // the accents from bin/accents.txt, e.g. "0,2"
 }
 
 // kanji element
 type JMDictK_ele struct {
 	KanjiSpelling string `xml:"keb" bson:"kanji_spelling,omitempty" json:"kanji_spelling,omitempty"`
 	//Ke_inf        []string `xml:"ke_inf" bson:"information,omitempty" json:"information,omitempty"` // denotes orthography, e.g. okurigana irregularity
-	//Ke_pri        []string `xml:"ke_pri" bson:"priority,omitempty" json:"priority,omitempty"`       // relative priority (see schema)
+	Ke_pri []string `xml:"ke_pri" bson:"priority,omitempty" json:"priority,omitempty"` // relative priority (see schema)
 }
 
 type JMDictEx_srce struct {
@@ -278,7 +572,7 @@ type KanjiMiscVariant struct {
 
 type KanjiReadingMeaning struct {
 	Group  []KanjiRMGroup `xml:"rmgroup,omitempty" json:"group,omitempty"`
-	Nanori []string       `xml:"nanori.omitempty" json:"nanori,omitempty"`
+	Nanori []string       `xml:"nanori,omitempty" json:"nanori,omitempty"`
 }
 
 type KanjiRMGroup struct {
@@ -4,11 +4,13 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-
-	// "math"
 	"net/http"
-	//"time"
+	"sort"
+	"strconv"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -41,59 +43,144 @@ func WordDrill(w http.ResponseWriter, r *http.Request) {
 	}
 	defer sqldb.Close()
 
-	baseForms, err := getStoryWords(drillRequest.StoryIds, sqldb)
+	if drillRequest.Filter == "" {
+		drillRequest.Filter = DRILL_FILTER_ALL
+	}
+	if drillRequest.Filter != DRILL_FILTER_ALL && drillRequest.Filter != DRILL_FILTER_ON_COOLDOWN &&
+		drillRequest.Filter != DRILL_FILTER_OFF_COOLDOWN {
+		w.WriteHeader(http.StatusBadRequest)
+		gw.Write([]byte(`{ "message": "` + "invalid drill filter: " + drillRequest.Filter + `"}`))
+		return
+	}
+	if drillRequest.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		gw.Write([]byte(`{ "message": "` + "invalid drill limit: " + strconv.Itoa(drillRequest.Limit) + `"}`))
+		return
+	}
+
+	drill, err := getDrillWords(drillRequest, time.Now().Unix(), sqldb)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		gw.Write([]byte(`{ "message": "` + err.Error() + `"}`))
 		return
 	}
 
-	rows, err := sqldb.Query(`SELECT id, base_form, rank, date_marked, category FROM words;`)
+	notes, err := getWordNotes(sqldb)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		gw.Write([]byte(`{ "message": "` + "failure to get word: " + err.Error() + `"}`))
+		gw.Write([]byte(`{ "message": "` + err.Error() + `"}`))
 		return
 	}
+
+	wordInfoMap := make(map[string]WordInfo)
+	for _, word := range drill.Words {
+		wordInfoMap[word.BaseForm] = getWordInfo(word, notes[word.ID])
+	}
+
+	json.NewEncoder(gw).Encode(bson.M{
+		"words":                   drill.Words,
+		"wordInfoMap":             wordInfoMap,
+		"countsByRank":            drill.CountsByRank,
+		"offCooldownCountsByRank": drill.OffCooldownCountsByRank,
+		"total":                   drill.Total,
+	})
+}
+
+// the due date by rank cooldown alone; see Scheduler for the due date used in drills
+func drillDueDate(word DrillWord, settings UserSettings) int64 {
+	return word.DateMarked + settings.Cooldown(word.Rank)
+}
+
+// the words of the requested stories which pass the request's filters, ordered by the
+// user's scheduler with the longest overdue first (words on cooldown follow in the order they come off cooldown),
+// along with counts per rank of all the stories' words before filtering
+func getDrillWords(drillRequest DrillRequest, now int64, sqldb *sql.DB) (DrillWords, error) {
+	drill := DrillWords{Words: make([]DrillWord, 0)}
+
+	// a story id of 0 selects all stories
+	allStories := len(drillRequest.StoryIds) == 0
+	for _, id := range drillRequest.StoryIds {
+		if id == 0 {
+			allStories = true
+		}
+	}
+
+	baseForms, err := getStoryWords(drillRequest.StoryIds, sqldb)
+	if err != nil {
+		return drill, err
+	}
+
+	settings, dueDate, err := getDueDateFunc(sqldb)
+	if err != nil {
+		return drill, err
+	}
+	drill.CountsByRank = make([]int, settings.RankCount+1)
+	drill.OffCooldownCountsByRank = make([]int, settings.RankCount+1)
+
+	// suspended words are left out of drills entirely
+	rows, err := sqldb.Query(`SELECT id, base_form, rank, date_marked, category, drill_count, lapses, leech
+		FROM words WHERE suspended = 0;`)
+	if err != nil {
+		return drill, fmt.Errorf("failure to get word: " + err.Error())
+	}
 	defer rows.Close()
 
-	words := make([]DrillWord, 0)
+	allCategories := drillRequest.CategoryMask == 0 || drillRequest.CategoryMask == -1
+
 	for rows.Next() {
 		var word DrillWord
 		err = rows.Scan(&word.ID, &word.BaseForm,
 			&word.Rank, &word.DateMarked,
-			&word.Category)
+			&word.Category, &word.DrillCount,
+			&word.Lapses, &word.Leech)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			gw.Write([]byte(`{ "message": "` + "failure to scan word: " + err.Error() + `"}`))
-			return
+			return drill, fmt.Errorf("failure to scan word: " + err.Error())
 		}
-		if len(drillRequest.StoryIds) == 0 {
-			words = append(words, word)
-		} else if _, ok := baseForms[word.BaseForm]; ok {
-			words = append(words, word)
+		if !allStories && !baseForms[word.BaseForm] {
+			continue
 		}
-	}
 
-	wordInfoMap := make(map[string]WordInfo)
+		word.Due = dueDate(word)
+		offCooldown := now > word.Due
+		drill.Total++
+		if word.Rank >= 0 && word.Rank < len(drill.CountsByRank) {
+			drill.CountsByRank[word.Rank]++
+			if offCooldown {
+				drill.OffCooldownCountsByRank[word.Rank]++
+			}
+		}
 
-	for _, word := range words {
-		wordInfo := WordInfo{
-			Definitions: getDefinitions(word.BaseForm),
+		if !allCategories && word.Category&drillRequest.CategoryMask == 0 {
+			continue
+		}
+		if (drillRequest.MinRank > 0 && word.Rank < drillRequest.MinRank) ||
+			(drillRequest.MaxRank > 0 && word.Rank > drillRequest.MaxRank) {
+			continue
+		}
+		if (drillRequest.Filter == DRILL_FILTER_OFF_COOLDOWN && !offCooldown) ||
+			(drillRequest.Filter == DRILL_FILTER_ON_COOLDOWN && offCooldown) {
+			continue
 		}
 
-		row := sqldb.QueryRow(`SELECT rank, date_marked FROM words WHERE base_form = $1;`, word.BaseForm)
+		drill.Words = append(drill.Words, word)
+	}
 
-		err = row.Scan(&wordInfo.Rank, &wordInfo.DateMarked)
-		if err != nil && err != sql.ErrNoRows {
-			w.WriteHeader(http.StatusInternalServerError)
-			gw.Write([]byte(`{ "message": "` + "failure to get word info: " + err.Error() + `"}`))
-			return
+	sort.SliceStable(drill.Words, func(i, j int) bool {
+		a, b := drill.Words[i], drill.Words[j]
+		if a.Due != b.Due {
+			return a.Due < b.Due
+		}
+		if a.Rank != b.Rank {
+			return a.Rank < b.Rank
 		}
+		return a.ID < b.ID
+	})
 
-		wordInfoMap[word.BaseForm] = wordInfo
+	if drillRequest.Limit > 0 && len(drill.Words) > drillRequest.Limit {
+		drill.Words = drill.Words[:drillRequest.Limit]
 	}
 
-	json.NewEncoder(gw).Encode(bson.M{"words": words, "wordInfoMap": wordInfoMap})
+	return drill, nil
 }
 
 func getStoryWords(storyIds []int64, sqldb *sql.DB) (map[string]bool, error) {
@@ -119,9 +206,6 @@ func getStoryWords(storyIds []int64, sqldb *sql.DB) (map[string]bool, error) {
 			}
 
 			for _, line := range lines {
-				for _, kanji := range line.Kanji {
-					baseForms[kanji.Character] = true
-				}
 				for _, word := range line.Words {
 					baseForms[word.BaseForm] = true
 				}
@@ -151,9 +235,6 @@ func getStoryWords(storyIds []int64, sqldb *sql.DB) (map[string]bool, error) {
 			}
 
 			for _, line := range lines {
-				for _, kanji := range line.Kanji {
-					baseForms[kanji.Character] = true
-				}
 				for _, word := range line.Words {
 					baseForms[word.BaseForm] = true
 				}
@@ -188,27 +269,195 @@ func UpdateWord(w http.ResponseWriter, r *http.Request) {
 	}
 	defer sqldb.Close()
 
-	row := sqldb.QueryRow(`SELECT id FROM words WHERE base_form = $1;`, word.BaseForm)
-	var id int64
-	err = row.Scan(&id)
+	tx, err := sqldb.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + "failure to begin transaction: " + err.Error() + `"}`))
+		return
+	}
+	defer tx.Rollback()
+
+	word, err = updateWord(word, tx)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`{ "message": "` + "cannot update word; word not found" + err.Error() + `"}`))
+			w.Write([]byte(`{ "message": "` + "cannot update word; word not found" + `"}`))
+			return
+		}
+		if errors.Is(err, errInvalidRank) || errors.Is(err, errInvalidAnswer) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{ "message": "` + "error looking up word " + err.Error() + `"}`))
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
 		return
 	}
 
-	_, err = sqldb.Exec(`UPDATE words SET rank = $1, date_marked = $2 WHERE base_form = $3;`,
-		word.Rank, word.DateMarked, word.BaseForm)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{ "message": "` + "failure to update word: " + err.Error() + `"}`))
+		w.Write([]byte(`{ "message": "` + "failure to commit word update: " + err.Error() + `"}`))
 		return
 	}
 
 	json.NewEncoder(w).Encode(word)
 }
+
+// applies many word updates in one transaction, e.g. a whole drill session; an update
+// which fails is undone and reported in its result without affecting the others
+func UpdateWords(w http.ResponseWriter, r *http.Request) {
+	dbPath, redirect, err := GetUserDb(w, r)
+	if redirect || err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var batch WordBatchUpdate
+	err = json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	sqldb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+	defer sqldb.Close()
+
+	result, err := updateWords(batch.Words, sqldb)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{ "message": "` + err.Error() + `"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// each update runs in its own savepoint so that a failed update rolls back only its own writes;
+// the returned error is for failures of the transaction as a whole
+func updateWords(words []WordUpdate, sqldb *sql.DB) (WordBatchResult, error) {
+	result := WordBatchResult{Results: make([]WordUpdateResult, len(words))}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failure to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	for i, word := range words {
+		itemResult := &result.Results[i]
+		itemResult.Index = i
+		itemResult.BaseForm = word.BaseForm
+
+		if _, err := tx.Exec(`SAVEPOINT word_update;`); err != nil {
+			return result, fmt.Errorf("failure to create savepoint: " + err.Error())
+		}
+
+		updated, err := updateWord(word, tx)
+		if err != nil {
+			if _, rollbackErr := tx.Exec(`ROLLBACK TO word_update;`); rollbackErr != nil {
+				return result, fmt.Errorf("failure to roll back word update: " + rollbackErr.Error())
+			}
+			if err == sql.ErrNoRows {
+				itemResult.Error = "word not found"
+			} else {
+				itemResult.Error = err.Error()
+			}
+			result.Failed++
+		} else {
+			itemResult.Word = &updated
+			result.Updated++
+		}
+
+		if _, err := tx.Exec(`RELEASE word_update;`); err != nil {
+			return result, fmt.Errorf("failure to release savepoint: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failure to commit word updates: " + err.Error())
+	}
+
+	return result, nil
+}
+
+// sets the word's rank and date marked; an answer is also recorded as a review,
+// counted in drill_count, and counted as an encounter of each of the word's kanji,
+// and a wrong answer may be a lapse (see addLapse).
+// Returns sql.ErrNoRows if the word doesn't exist, errInvalidRank if the rank
+// is outside the user's rank count, and errInvalidAnswer for an unknown answer.
+func updateWord(word WordUpdate, tx *sql.Tx) (WordUpdate, error) {
+	if word.Answer != "" && word.Answer != REVIEW_ANSWER_CORRECT && word.Answer != REVIEW_ANSWER_WRONG {
+		return word, fmt.Errorf("%w: answer must be '%s' or '%s'", errInvalidAnswer, REVIEW_ANSWER_CORRECT, REVIEW_ANSWER_WRONG)
+	}
+
+	settings, err := getSettings(tx)
+	if err != nil {
+		return word, err
+	}
+	if word.Rank < 1 || word.Rank > settings.RankCount {
+		return word, fmt.Errorf("%w: rank must be between 1 and %d", errInvalidRank, settings.RankCount)
+	}
+
+	var id int64
+	var oldRank int
+	row := tx.QueryRow(`SELECT id, rank FROM words WHERE base_form = $1;`, word.BaseForm)
+	if err := row.Scan(&id, &oldRank); err != nil {
+		if err == sql.ErrNoRows {
+			return word, err
+		}
+		return word, fmt.Errorf("error looking up word: " + err.Error())
+	}
+
+	_, err = tx.Exec(`UPDATE words SET rank = $1, date_marked = $2 WHERE id = $3;`,
+		word.Rank, word.DateMarked, id)
+	if err != nil {
+		return word, fmt.Errorf("failure to update word: " + err.Error())
+	}
+
+	if word.Answer != "" {
+		correct := word.Answer == REVIEW_ANSWER_CORRECT
+		if !correct {
+			if err := addLapse(id, settings, tx); err != nil {
+				return word, err
+			}
+		}
+		err = addReview(id, word.DateMarked, correct, oldRank, word.Rank, tx)
+		if err != nil {
+			return word, err
+		}
+		err = scheduleReview(id, correct, word.DateMarked, tx)
+		if err != nil {
+			return word, err
+		}
+		err = addKanjiEncounters(word.BaseForm, tx)
+		if err != nil {
+			return word, err
+		}
+	}
+
+	row = tx.QueryRow(`SELECT drill_count, lapses, leech, suspended FROM words WHERE id = $1;`, id)
+	if err := row.Scan(&word.DrillCount, &word.Lapses, &word.Leech, &word.Suspended); err != nil {
+		return word, fmt.Errorf("failure to read drill count: " + err.Error())
+	}
+
+	scheduler, ok := getScheduler(settings.Scheduler)
+	if !ok {
+		return word, fmt.Errorf("unknown scheduler: " + settings.Scheduler)
+	}
+	state, err := getWordSchedule(id, scheduler.Name(), tx)
+	if err != nil {
+		return word, err
+	}
+	word.Due = scheduler.DueDate(DrillWord{ID: id, Rank: word.Rank, DateMarked: word.DateMarked}, state, settings)
+
+	return word, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// the mora after which the pitch drops (0 for no drop); some accents are given per part
+// of speech, e.g. "(副)0,(名)3", which only matters for the order
+var accentNumber = regexp.MustCompile(`[0-9]+`)
+
+// reads the tab separated spelling, reading and accents of accents.txt, keyed by
+// accentKey; words written only in kana have an empty reading
+func loadAccents(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failure to open accents: " + err.Error())
+	}
+	defer file.Close()
+
+	accents := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		spelling, reading := fields[0], fields[1]
+		if reading == "" {
+			reading = spelling
+		}
+		if pitch := normaliseAccents(fields[2]); pitch != "" {
+			accents[accentKey(spelling, reading)] = pitch
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failure to read accents: " + err.Error())
+	}
+	return accents, nil
+}
+
+func accentKey(spelling string, reading string) string {
+	return spelling + "\t" + reading
+}
+
+// the distinct accents in the order given, comma separated (e.g. "0,3"), as the client expects
+func normaliseAccents(accents string) string {
+	numbers := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, number := range accentNumber.FindAllString(accents, -1) {
+		if !seen[number] {
+			seen[number] = true
+			numbers = append(numbers, number)
+		}
+	}
+	return strings.Join(numbers, ",")
+}
+
+// sets the pitch of each reading from the accents of the first of the entry's kanji
+// spellings which has them, or for entries without kanji spellings, the accents of the
+// reading itself (a kana homophone's accents needn't be the kanji word's); returns the
+// number of readings given a pitch
+func addPitch(dict *JMDict, accents map[string]string) int {
+	count := 0
+	for i := range dict.Entries {
+		entry := &dict.Entries[i]
+		for j := range entry.Readings {
+			reading := &entry.Readings[j]
+			for _, kanji := range entry.KanjiSpellings {
+				if pitch, ok := accents[accentKey(kanji.KanjiSpelling, reading.Reading)]; ok {
+					reading.Pitch = pitch
+					break
+				}
+			}
+			if len(entry.KanjiSpellings) == 0 {
+				reading.Pitch = accents[accentKey(reading.Reading, reading.Reading)]
+			}
+			if reading.Pitch != "" {
+				count++
+			}
+		}
+	}
+	return count
+}
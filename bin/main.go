@@ -0,0 +1,288 @@
+// Builds the dictionary zips the server loads at startup (../entries.zip and ../kanji.zip)
+// from the EDRDG's JMdict_e.xml and kanjidic2.xml, adding the pitch accents of accents.txt:
+//
+//	go run . -jmdict JMdict_e.xml -kanjidic kanjidic2.xml
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func main() {
+	jmdictPath := flag.String("jmdict", "JMdict_e.xml", "JMdict xml to read (empty to skip)")
+	kanjidicPath := flag.String("kanjidic", "kanjidic2.xml", "kanjidic2 xml to read (empty to skip)")
+	accentsPath := flag.String("accents", "accents.txt", "pitch accents to add to the JMdict readings (empty to skip)")
+	entriesPath := flag.String("entries", "../entries.zip", "zip of the JMdict entries to write")
+	kanjiPath := flag.String("kanji", "../kanji.zip", "zip of the kanji to write")
+	flag.Parse()
+
+	if *jmdictPath != "" {
+		start := time.Now()
+		dict, err := parseJMDict(*jmdictPath)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("entries: ", len(dict.Entries), " time to parse: ", time.Since(start))
+
+		if *accentsPath != "" {
+			accents, err := loadAccents(*accentsPath)
+			if err != nil {
+				fail(err)
+			}
+			fmt.Println("readings with pitch: ", addPitch(&dict, accents), " of accents: ", len(accents))
+		}
+
+		if err := writeBSONZip(*entriesPath, "entries.bson", dict); err != nil {
+			fail(err)
+		}
+	}
+
+	if *kanjidicPath != "" {
+		start := time.Now()
+		dict, err := parseKanjiDict(*kanjidicPath)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("kanji: ", len(dict.Characters), " time to parse: ", time.Since(start))
+
+		if err := writeBSONZip(*kanjiPath, "kanji.bson", dict); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// JMdict declares its entities (parts of speech, misc and dialect tags, etc.) in its DTD
+var entityDeclaration = regexp.MustCompile(`<!ENTITY\s+(\S+)\s+"([^"]*)">`)
+
+func parseJMDict(path string) (JMDict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return JMDict{}, fmt.Errorf("failure to read jmdict: " + err.Error())
+	}
+
+	// entities are decoded as their names (e.g. "v5k") so the parts of speech can be
+	// normalised below; the other entities get the descriptions the DTD gives them
+	descriptions := make(map[string]string)
+	entities := make(map[string]string)
+	for _, match := range entityDeclaration.FindAllSubmatch(data, -1) {
+		name := string(match[1])
+		descriptions[name] = string(match[2])
+		entities[name] = name
+	}
+
+	dict := JMDict{Entries: make([]JMDictEntry, 0)}
+	err = decodeElements(data, "entry", entities, func(decoder *xml.Decoder, start *xml.StartElement) error {
+		var entry JMDictEntry
+		if err := decoder.DecodeElement(&entry, start); err != nil {
+			return err
+		}
+		for i := range entry.Senses {
+			for j, pos := range entry.Senses[i].Pos {
+				entry.Senses[i].Pos[j] = normalisePos(pos)
+			}
+		}
+		for i := range entry.Readings {
+			for j, inf := range entry.Readings[i].Re_inf {
+				if description, ok := descriptions[inf]; ok {
+					entry.Readings[i].Re_inf[j] = description
+				}
+			}
+		}
+		dict.Entries = append(dict.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return JMDict{}, fmt.Errorf("failure to parse jmdict: " + err.Error())
+	}
+	return dict, nil
+}
+
+func parseKanjiDict(path string) (KanjiDict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return KanjiDict{}, fmt.Errorf("failure to read kanjidic: " + err.Error())
+	}
+
+	dict := KanjiDict{Characters: make([]KanjiCharacter, 0)}
+	err = decodeElements(data, "character", nil, func(decoder *xml.Decoder, start *xml.StartElement) error {
+		var character KanjiCharacter
+		if err := decoder.DecodeElement(&character, start); err != nil {
+			return err
+		}
+		character.XMLName = nil
+		dict.Characters = append(dict.Characters, character)
+		return nil
+	})
+	if err != nil {
+		return KanjiDict{}, fmt.Errorf("failure to parse kanjidic: " + err.Error())
+	}
+	return dict, nil
+}
+
+// calls decodeFn for each element of the given name, so the document's root element
+// needn't match the dictionary types' XMLName
+func decodeElements(data []byte, name string, entities map[string]string,
+	decodeFn func(*xml.Decoder, *xml.StartElement) error) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Entity = entities
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			if err := decodeFn(decoder, &start); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// the names the server uses for the JMdict parts of speech (see getVerbCategory); unknown
+// parts of speech keep their entity name
+func normalisePos(pos string) string {
+	if name, ok := posNames[pos]; ok {
+		return name
+	}
+	return pos
+}
+
+var posNames = map[string]string{
+	"adj-f":     "adjective-prenominal-phrase",
+	"adj-i":     "adjective-i",
+	"adj-ix":    "adjective-ii",
+	"adj-kari":  "adjective-kari",
+	"adj-ku":    "adjective-ku",
+	"adj-na":    "adjective-na",
+	"adj-nari":  "adjective-nari",
+	"adj-no":    "adjective-no",
+	"adj-pn":    "adjective-prenominal",
+	"adj-shiku": "adjective-shiku",
+	"adj-t":     "adjective-taru",
+	"adv":       "adverb",
+	"adv-to":    "adverb-to",
+	"aux":       "auxiliary",
+	"aux-adj":   "auxiliary-adjective",
+	"aux-v":     "auxiliary-verb",
+	"conj":      "conjunction",
+	"cop":       "copula",
+	"ctr":       "counter",
+	"exp":       "expression",
+	"int":       "interjection",
+	"n":         "noun",
+	"n-adv":     "noun-adverbial",
+	"n-pr":      "noun-proper",
+	"n-pref":    "noun-prefix",
+	"n-suf":     "noun-suffix",
+	"n-t":       "noun-temporal",
+	"num":       "numeric",
+	"pn":        "pronoun",
+	"pref":      "prefix",
+	"prt":       "particle",
+	"suf":       "suffix",
+	"unc":       "unclassified",
+	"v-unspec":  "verb-unspecified",
+	"v1":        "verb-ichidan",
+	"v1-s":      "verb-ichidan-kureru",
+	"v2a-s":     "verb-nidan-u",
+	"v2b-k":     "verb-nidan-bu-kami",
+	"v2b-s":     "verb-nidan-bu-shimo",
+	"v2d-k":     "verb-nidan-dzu-kami",
+	"v2d-s":     "verb-nidan-dzu-shimo",
+	"v2g-k":     "verb-nidan-gu-kami",
+	"v2g-s":     "verb-nidan-gu-shimo",
+	"v2h-k":     "verb-nidan-fu-kami",
+	"v2h-s":     "verb-nidan-fu-shimo",
+	"v2k-k":     "verb-nidan-ku-kami",
+	"v2k-s":     "verb-nidan-ku-shimo",
+	"v2m-k":     "verb-nidan-mu-kami",
+	"v2m-s":     "verb-nidan-mu-shimo",
+	"v2n-s":     "verb-nidan-nu-shimo",
+	"v2r-k":     "verb-nidan-ru-kami",
+	"v2r-s":     "verb-nidan-ru-shimo",
+	"v2s-s":     "verb-nidan-su-shimo",
+	"v2t-k":     "verb-nidan-tsu-kami",
+	"v2t-s":     "verb-nidan-tsu-shimo",
+	"v2w-s":     "verb-nidan-u-we-shimo",
+	"v2y-k":     "verb-nidan-yu-kami",
+	"v2y-s":     "verb-nidan-yu-shimo",
+	"v2z-s":     "verb-nidan-zu-shimo",
+	"v4b":       "verb-yodan-bu",
+	"v4g":       "verb-yodan-gu",
+	"v4h":       "verb-yodan-fu",
+	"v4k":       "verb-yodan-ku",
+	"v4m":       "verb-yodan-mu",
+	"v4n":       "verb-yodan-nu",
+	"v4r":       "verb-yodan-ru",
+	"v4s":       "verb-yodan-su",
+	"v4t":       "verb-yodan-tsu",
+	"v5aru":     "verb-godan-aru",
+	"v5b":       "verb-godan-bu",
+	"v5g":       "verb-godan-gu",
+	"v5k":       "verb-godan-ku",
+	"v5k-s":     "verb-godan-iku",
+	"v5m":       "verb-godan-mu",
+	"v5n":       "verb-godan-nu",
+	"v5r":       "verb-godan-ru",
+	"v5r-i":     "verb-godan-ru-irregular",
+	"v5s":       "verb-godan-su",
+	"v5t":       "verb-godan-tsu",
+	"v5u":       "verb-godan-u",
+	"v5u-s":     "verb-godan-u-special",
+	"v5uru":     "verb-godan-uru",
+	"vi":        "verb-intransitive",
+	"vk":        "verb-kuru",
+	"vn":        "verb-nu-irregular",
+	"vr":        "verb-ru-irregular",
+	"vs":        "verb-suru",
+	"vs-c":      "verb-su",
+	"vs-i":      "verb-suru-included",
+	"vs-s":      "verb-suru-special",
+	"vt":        "verb-transitive",
+	"vz":        "verb-zuru",
+}
+
+// the server reads the first file of each zip
+func writeBSONZip(path string, name string, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failure to marshal " + name + ": " + err.Error())
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failure to create " + path + ": " + err.Error())
+	}
+	defer file.Close()
+
+	zipWriter := zip.NewWriter(file)
+	writer, err := zipWriter.Create(name)
+	if err != nil {
+		return fmt.Errorf("failure to add " + name + " to zip: " + err.Error())
+	}
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("failure to write " + name + ": " + err.Error())
+	}
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("failure to write " + path + ": " + err.Error())
+	}
+	return file.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testJMDict = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE JMdict [
+<!ENTITY v5k "Godan verb with 'ku' ending">
+<!ENTITY vt "transitive verb">
+<!ENTITY ik "word containing irregular kana usage">
+<!ENTITY xyz "an entity the server doesn't know">
+]>
+<JMdict>
+<entry>
+<ent_seq>1405800</ent_seq>
+<k_ele><keb>書く</keb></k_ele>
+<r_ele><reb>かく</reb></r_ele>
+<r_ele><reb>かゝく</reb><re_inf>&ik;</re_inf></r_ele>
+<sense>
+<pos>&v5k;</pos>
+<pos>&vt;</pos>
+<pos>&xyz;</pos>
+<gloss>to write</gloss>
+</sense>
+</entry>
+</JMdict>
+`
+
+func TestParseJMDict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "JMdict_e.xml")
+	if err := os.WriteFile(path, []byte(testJMDict), 0644); err != nil {
+		t.Fatal("fail write jmdict: ", err)
+	}
+
+	dict, err := parseJMDict(path)
+	if err != nil {
+		t.Fatal("fail parse jmdict: ", err)
+	}
+	if len(dict.Entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(dict.Entries))
+	}
+	entry := dict.Entries[0]
+	if entry.Ent_seq != "1405800" || entry.KanjiSpellings[0].KanjiSpelling != "書く" || len(entry.Readings) != 2 {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	// the server's getVerbCategory expects these names; unknown parts of speech keep their entity name
+	pos := entry.Senses[0].Pos
+	if len(pos) != 3 || pos[0] != "verb-godan-ku" || pos[1] != "verb-transitive" || pos[2] != "xyz" {
+		t.Errorf("unexpected parts of speech: %v", pos)
+	}
+	if inf := entry.Readings[1].Re_inf; len(inf) != 1 || inf[0] != "word containing irregular kana usage" {
+		t.Errorf("expected the reading info's description, got %v", inf)
+	}
+	if len(entry.Readings[0].Re_inf) != 0 {
+		t.Errorf("expected no info for the first reading, got %v", entry.Readings[0].Re_inf)
+	}
+}
+
+func TestAddPitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accents.txt")
+	accentsText := "書く\tかく\t1\n" +
+		"かく\t\t2\n" +
+		"ああ\t\t(副)0,(名)3,0\n" +
+		"malformed line\n"
+	if err := os.WriteFile(path, []byte(accentsText), 0644); err != nil {
+		t.Fatal("fail write accents: ", err)
+	}
+
+	accents, err := loadAccents(path)
+	if err != nil {
+		t.Fatal("fail load accents: ", err)
+	}
+	if len(accents) != 3 || accents[accentKey("ああ", "ああ")] != "0,3" {
+		t.Errorf("expected the accents of each part of speech once, in order, got %v", accents)
+	}
+
+	dict := JMDict{Entries: []JMDictEntry{
+		{KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "書く"}}, Readings: []JMDictR_ele{{Reading: "かく"}}},
+		{Readings: []JMDictR_ele{{Reading: "ああ"}}},
+		// a homophone of the kana word かく, without accents of its own
+		{KanjiSpellings: []JMDictK_ele{{KanjiSpelling: "核"}}, Readings: []JMDictR_ele{{Reading: "かく"}}},
+	}}
+	if count := addPitch(&dict, accents); count != 2 {
+		t.Errorf("expected two readings given a pitch, got %d", count)
+	}
+	if pitch := dict.Entries[0].Readings[0].Pitch; pitch != "1" {
+		t.Errorf("expected the kanji spelling's accent, got %q", pitch)
+	}
+	if pitch := dict.Entries[1].Readings[0].Pitch; pitch != "0,3" {
+		t.Errorf("expected the kana word's accents, got %q", pitch)
+	}
+	if pitch := dict.Entries[2].Readings[0].Pitch; pitch != "" {
+		t.Errorf("expected no pitch for the homophone, got %q", pitch)
+	}
+}
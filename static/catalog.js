@@ -3,6 +3,7 @@ var newStoryText = document.getElementById('new_story_text');
 var newStoryButton = document.getElementById('new_story_button');
 var newStoryTitle = document.getElementById('new_story_title');
 var newStoryLink = document.getElementById('new_story_link');
+var importSubtitles = document.getElementById('import_subtitles');
 
 document.body.onload = function (evt) {
     getStoryList(displayStoryList);
@@ -28,12 +29,78 @@ newStoryButton.onclick = function (evt) {
     }).then((response) => response.json())
         .then((data) => {
             getStoryList(displayStoryList);
+            pollTokenizeStatus(data.id);
         })
         .catch((error) => {
             console.error('Error:', error);
         });
 };
 
+// the title defaults to the file name if left blank
+importSubtitles.onchange = function (evt) {
+    let file = importSubtitles.files[0];
+    if (!file) {
+        return;
+    }
+    let extension = file.name.split('.').pop();
+    file.text().then((subtitles) => {
+        let data = {
+            title: newStoryTitle.value || file.name.slice(0, -(extension.length + 1)),
+            link: newStoryLink.value,
+            format: extension,
+            subtitles: subtitles
+        };
+
+        newStoryTitle.value = '';
+        newStoryLink.value = '';
+        importSubtitles.value = '';
+
+        return fetch('/import_subtitles', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(data),
+        });
+    }).then((response) => response.json())
+        .then((data) => {
+            if (!data.id) {
+                snackbarMessage(`failed to import subtitles: ${data.message}`);
+                return;
+            }
+            getStoryList(displayStoryList);
+            pollTokenizeStatus(data.id);
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+};
+
+const TOKENIZE_POLL_INTERVAL = 2000; // milliseconds
+
+// refresh the list once the new story's background tokenizing finishes
+function pollTokenizeStatus(storyId) {
+    fetch(`/tokenize_status/${storyId}`, {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then((data) => {
+            if (data.state === 'queued' || data.state === 'running') {
+                setTimeout(() => pollTokenizeStatus(storyId), TOKENIZE_POLL_INTERVAL);
+                return;
+            }
+            if (data.state === 'failed') {
+                snackbarMessage(`failed to tokenize story: ${data.error}`);
+            }
+            getStoryList(displayStoryList);
+        })
+        .catch((error) => {
+            console.error('Error getting tokenize status:', error);
+        });
+}
+
 storyList.onchange = function (evt) {
     if (evt.target.className.includes('count_spinner')) {
         let storyId = parseInt(evt.target.getAttribute('story_id'));
@@ -43,6 +110,26 @@ storyList.onchange = function (evt) {
     }
 };
 
+storyList.onclick = function (evt) {
+    if (evt.target.getAttribute('action') === 'enqueue') {
+        evt.preventDefault();
+        let storyId = parseInt(evt.target.getAttribute('story_id'));
+        fetch('/enqueue_story', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ story_id: storyId, count: 1 }),
+        }).then((response) => response.json())
+            .then((data) => {
+                snackbarMessage(`story queued (${data.length} in queue)`);
+            })
+            .catch((error) => {
+                console.error('Error enqueuing:', error);
+            });
+    }
+};
+
 function retokenizeStory(story) {
     fetch('/retokenize_story', {
         method: 'POST', // or 'PUT'
@@ -75,7 +162,8 @@ function displayStoryList(stories) {
             <td>
                 <span title="number of times this story has been read">${s.read_count}</span>
             </td>
-            <td><a class="story_title" story_id="${s.id}" href="/story.html?storyId=${s.id}">${s.title}</a></td>
+            <td><a action="enqueue" story_id="${s.id}" href="#" title="add this story to the end of the reading queue">enqueue</a></td>
+            <td><a class="story_title" story_id="${s.id}" href="/story.html?storyId=${s.id}">${s.title}</a>${s.is_tokenized ? '' : ' (tokenizing...)'}</td>
             </tr>`;
     }
 
@@ -84,6 +172,7 @@ function displayStoryList(stories) {
         <tr>
             <th>TODO</th>
             <th title="number of times this story has been read">Read count</th>
+            <th>Queue</th>
             <th>Title</th>
         </tr>`;
 
@@ -1,26 +1,54 @@
 var storyTitle = document.getElementById('story_title');
 var storiesDiv = document.getElementById('stories');
+var queueDiv = document.getElementById('queue');
+
+const QUEUE_DISPLAY_LIMIT = 10;
 
 document.body.onload = function (evt) {
     getStoryList(displayStoryList);
+    getQueue(QUEUE_DISPLAY_LIMIT, displayQueue);
 };
 
 
 
 storiesDiv.onclick = function(evt) {
     if (evt.target.tagName == 'A') {
-        var logId = evt.target.getAttribute('log_id');
         var storyId = evt.target.getAttribute('story_id');
         var action = evt.target.getAttribute('action');
         switch (action) {
             case 'log':
                 evt.preventDefault();
-                logScheduledStory(logId, storyId);
+                logScheduledStory(storyId);
                 break;
         }
     }
 };
 
+queueDiv.onclick = storiesDiv.onclick;
+
+function logScheduledStory(storyId) {
+    addLogEvent(storyId, (data) => {
+        getStoryList(displayStoryList);
+        getQueue(QUEUE_DISPLAY_LIMIT, displayQueue);
+    });
+}
+
+function displayQueue(queue) {
+    if (queue.length === 0) {
+        queueDiv.innerHTML = '<p>nothing queued</p>';
+        return;
+    }
+
+    let html = `<table class="story_table">`;
+    for (let entry of queue) {
+        html += `<tr>
+            <td><a action="log" story_id="${entry.story_id}" href="#" title="log a read of this story">mark read</a></td>
+            <td><a class="story_title" story_id="${entry.story_id}" href="/story.html?storyId=${entry.story_id}">${entry.title}</a></td>
+            </tr>`;
+    }
+    queueDiv.innerHTML = html + '</table>';
+}
+
 function openStory(id) {
     fetch('/story/' + id, {
         method: 'GET', // or 'PUT'
@@ -5,15 +5,18 @@ var definitionsDiv = document.getElementById('definitions');
 var kanjiResultsDiv = document.getElementById('kanji_results');
 var playerSpeedNumber = document.getElementById('player_speed_number');
 var drillWordsLink = document.getElementById('drill_words_link');
+var exportLinks = document.getElementById('export_links');
 var highlightLink = document.getElementById('highlight_message');
 var audioPlayer = document.getElementById('audio_player');
 var playerControls = document.getElementById('player_controls');
 var markStoryLink = document.getElementById('mark_story');
 var countSpinner = document.getElementById('count_spinner');
+var audioUpload = document.getElementById('audio_upload');
 
 var story = null;
 var selectedLineIdx = 0;
 var videoPlayer;
+var settings = { rank_count: 4 };
 
 tokenizedStory.onwheel = function (evt) {
     evt.preventDefault();
@@ -34,26 +37,45 @@ function toggleHighlight(evt) {
     }
 }
 
-const STORY_MARK_COOLDOWN = 60 * 60 * 4;
+audioUpload.onchange = function (evt) {
+    if (audioUpload.files.length === 0) {
+        return;
+    }
+    let formData = new FormData();
+    formData.append('audio', audioUpload.files[0]);
+    fetch(`/story_audio/${story.id}`, {
+        method: 'POST',
+        body: formData,
+    }).then((response) => response.json())
+        .then((data) => {
+            if (!data.audio) {
+                snackbarMessage(data.message);
+                return;
+            }
+            story.audio = data.audio;
+            audioPlayer.style.display = 'block';
+            audioPlayer.src = '/audio/' + story.audio;
+            playerControls.style.display = 'inline';
+            snackbarMessage('uploaded story audio');
+        })
+        .catch((error) => {
+            console.error('Error uploading audio:', error);
+        });
+};
 
 markStoryLink.onclick = function (evt) {
     evt.preventDefault();
-    let unixTime = Math.floor(Date.now() / 1000);
-    if (story.date_last_read + STORY_MARK_COOLDOWN > unixTime) {
-        snackbarMessage("story cannot be marked right now because it's on cooldown");
-        return;
-    }
-    story.date_last_read = unixTime;
-    story.countdown = Math.max(story.countdown - 1, 0);
-    story.read_count++;
-    countSpinner.value = story.countdown;
-    updateStoryCounts(story, () => {
-        snackbarMessage('marked story as read');
+    // the server rejects the read if the story is on cooldown
+    addLogEvent(story.id, (data) => {
+        story.date_last_read = data.story.date_last_read;
+        story.countdown = data.story.countdown;
+        story.read_count = data.story.read_count;
+        countSpinner.value = story.countdown;
     });
 };
 
 document.body.onkeydown = async function (evt) {
-    if (evt.ctrlKey) {
+    if (evt.ctrlKey || isTextInput(evt.target)) {
         return;
     }
     //console.log(evt);
@@ -129,6 +151,7 @@ document.body.onkeydown = async function (evt) {
                 base_form: selectedWordBaseForm,
                 date_marked: Math.floor(Date.now() / 1000),
                 rank: wordInfo.rank,
+                answer: 'correct',
             }, story.word_info, true);
         }
     } else if (evt.code === 'KeyM') {
@@ -152,7 +175,7 @@ document.body.onkeydown = async function (evt) {
         evt.preventDefault();
         let digit = parseInt(evt.code.slice(-1));
         if (!evt.altKey) {
-            if (digit < 1 || digit > 4) {
+            if (digit < 1 || digit > settings.rank_count) {
                 return;
             }
             if (selectedWordBaseForm) {
@@ -310,6 +333,9 @@ function openStory(id) {
         .then((data) => {
             story = data;
             drillWordsLink.setAttribute('href', `/words.html?storyId=${story.id}`);
+            for (let format of ['html', 'srt', 'vtt']) {
+                exportLinks.querySelector(`#export_${format}`).setAttribute('href', `/export_story/${story.id}?format=${format}`);
+            }
             storyTitle.innerHTML = `<a href="${story.link}">${story.title}</a>`;
             console.log(story);
 
@@ -374,15 +400,31 @@ function displayStory(story) {
     for (let idx in story.lines) {
         let line = story.lines[idx];
         html += `<tr line_idx="${idx}"><td class="line_timestamp_container"><a class="line_timestamp ${line.marked ? 'marked_line' : ''}">${line.timestamp}</a></td><td>`;
-        for (let wordIdx in line.words) {
+        let wordSpan = (wordIdx) => {
             let word = line.words[wordIdx];
             let wordinfo = story.word_info[word.baseform];
             if (word.id) {
-                let offCooldown = isOffCooldown(wordinfo.rank, wordinfo.date_marked, unixTime);
-                html += `<span word_idx_in_line="${wordIdx}" word_id="${word.id || ''}" baseform="${word.baseform || ''}" 
+                let offCooldown = unixTime > wordinfo.due;
+                return `<span word_idx_in_line="${wordIdx}" word_id="${word.id || ''}" baseform="${word.baseform || ''}" 
                     class="lineword rank${wordinfo.rank} ${offCooldown ? 'offcooldown' : ''} ${word.pos || ''}">${word.surface}</span>`;
-            } else {
-                html += `<span word_idx_in_line="${wordIdx}" class="lineword nonword">${word.surface}</span>`;
+            }
+            return `<span word_idx_in_line="${wordIdx}" class="lineword nonword">${word.surface}</span>`;
+        };
+        if (line.paragraphs) {
+            for (let paragraph of line.paragraphs) {
+                html += '<div class="paragraph">';
+                for (let sentence of paragraph.sentences) {
+                    html += '<span class="sentence">';
+                    for (let wordIdx = sentence.start; wordIdx < sentence.end; wordIdx++) {
+                        html += wordSpan(wordIdx);
+                    }
+                    html += '</span>';
+                }
+                html += '</div>';
+            }
+        } else {
+            for (let wordIdx in line.words) {
+                html += wordSpan(wordIdx);
             }
         }
         html += '</td></tr>'
@@ -391,11 +433,6 @@ function displayStory(story) {
     tokenizedStory.innerHTML = html + '</table>';
 }
 
-function isOffCooldown(rank, dateMarked, unixTime) {
-    let timeSinceLastDrill = unixTime - dateMarked;
-    return timeSinceLastDrill > cooldownsByRank[rank];
-}
-
 var selectedWordBaseForm = null;
 
 function splitLine(target, lineIdx) {
@@ -444,14 +481,23 @@ function displayDefinition(baseform, surface) {
     getKanji(baseform + surface);
     html = '';
     let wordInfo = story.word_info[baseform];
+    // words not in the user's words have no rank and so no notes
+    let isWord = wordInfo && wordInfo.rank > 0;
+    if (isWord) {
+        html += displayWordNotes(baseform, wordInfo);
+    }
     if (wordInfo && wordInfo.definitions) {
         for (let entry of wordInfo.definitions) {
-            html += displayEntry(entry);
+            html += displayEntry(entry, isWord ? (wordInfo.primary_entry || '') : undefined);
         }
     }
     definitionsDiv.innerHTML = html;
 }
 
+addWordNoteHandlers(definitionsDiv, (baseForm) => story.word_info[baseForm], (baseForm) => {
+    displayDefinition(baseForm, '');
+});
+
 // loads the IFrame Player API code asynchronously.
 var tag = document.createElement('script');
 tag.src = "https://www.youtube.com/iframe_api";
@@ -462,6 +508,9 @@ firstScriptTag.parentNode.insertBefore(tag, firstScriptTag);
 function onYouTubeIframeAPIReady() {
     var url = new URL(window.location.href);
     var storyId = parseInt(url.searchParams.get("storyId") || undefined);
+    getSettings((data) => {
+        settings = data;
+    });
     openStory(storyId);
 }
 
@@ -1,22 +1,17 @@
-const DRILL_COOLDOWN_RANK_4 = 60 * 60 * 24 * 1000; // 1000 days in seconds
-const DRILL_COOLDOWN_RANK_3 = 60 * 60 * 24 * 30;  // 30 days in seconds
-const DRILL_COOLDOWN_RANK_2 = 60 * 60 * 24 * 4;   // 4 days in seconds
-const DRILL_COOLDOWN_RANK_1 = 60 * 60 * 5;        // 5 hours in second
-const cooldownsByRank = [0, DRILL_COOLDOWN_RANK_1, DRILL_COOLDOWN_RANK_2, DRILL_COOLDOWN_RANK_3, DRILL_COOLDOWN_RANK_4];
+// ranks are set with the digit keys, so there are at most 9
+const MAX_RANK_COUNT = 9;
 
 const STORY_STATUS_CURRENT = 2;
 const STORY_STATUS_NEVER_READ = 1;
 const STORY_STATUS_ARCHIVE = 0;
 
-function splitOnHighPitch(str, pitch) {
-    let [downPitch, upPitch] = pitch;
-    //console.log(`downpitch ${downPitch}, up pitch ${upPitch}`);
-
+// the reading split around the mora after which the pitch drops (downPitch 0 for no drop)
+function splitOnHighPitch(str, downPitch) {
     if (downPitch === 0) {
         return ['', '', str];
     }
     let mora = [];
-    let s = new Set(['ゅ', 'ょ', 'ゃ', 'ャ', 'ュ', 'ョ']);
+    let s = new Set(['ゅ', 'ょ', 'ゃ', 'ャ', 'ュ', 'ョ', 'ぁ', 'ぃ', 'ぅ', 'ぇ', 'ぉ', 'ァ', 'ィ', 'ゥ', 'ェ', 'ォ']);
     let chars = str.split('');
     for (let i = 0; i < chars.length; i++) {
         if (s.has(chars[i + 1])) {
@@ -117,17 +112,32 @@ function updateWordInfo(word, wordInfoMap, marking) {
         console.log('updating word info', word.base_form, word.rank, word.date_marked, 'found spans', wordSpans.length);
         let unixTime = Math.floor(Date.now() / 1000);
         for (let span of wordSpans) {
-            span.classList.remove('rank1', 'rank2', 'rank3', 'rank4');
-            span.classList.add('rank' + word.rank);
-            if (marking) {
-                span.classList.remove('offcooldown');
+            for (let rank = 1; rank <= MAX_RANK_COUNT; rank++) {
+                span.classList.remove('rank' + rank);
             }
+            span.classList.add('rank' + word.rank);
+            span.classList.toggle('offcooldown', unixTime > word.due);
         }
     }
 
     var wordInfo = wordInfoMap[word.base_form];
     wordInfo.rank = word.rank;
     wordInfo.date_marked = word.date_marked;
+    wordInfo.due = word.due;
+}
+
+// the user's scheduler, rank count and cooldowns
+function getSettings(successFn) {
+    fetch('/settings', {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then(successFn)
+        .catch((error) => {
+            console.error('Error:', error);
+        });
 }
 
 var snackebarTimeoutHandle = null;
@@ -165,13 +175,28 @@ function shuffle(array) {
 }
 
 
-function displayEntry(entry) {
+// identifies an entry among the homographs of a word (mirrors entryKey on the server)
+function entryKey(entry) {
+    return entry.sequence_number || '';
+}
+
+// JMdict gives priority tags only to the common spellings and readings
+function commonStar(ele) {
+    return (ele.priority && ele.priority.length > 0) ?
+        `<span class="common_star" title="common (${ele.priority.join(', ')})">★</span>` : '';
+}
+
+// if primaryEntry is given, the entry gets a toggle to make it the word's primary entry
+function displayEntry(entry, primaryEntry) {
     let readings = '';
     for (var r of entry.readings || []) {
+        readings += commonStar(r);
         if (r.pitch) {
-            let pitch = r.pitch.split(',').map(x => parseInt(x));
-            let parts = splitOnHighPitch(r.reading, pitch);
-            readings += `<span class="reading">${parts[0]}<span class="high_pitch">${parts[1]}</span>${parts[2]}</span>`;
+            // a reading may have more than one accent, e.g. "0,2"
+            for (let downPitch of r.pitch.split(',').map(x => parseInt(x))) {
+                let parts = splitOnHighPitch(r.reading, downPitch);
+                readings += `<span class="reading" title="accent ${downPitch}">${parts[0]}<span class="high_pitch">${parts[1]}</span>${parts[2]}</span>`;
+            }
         } else {
             readings += `<span class="reading unknown_pitch">${r.reading}﹖</span>`;
         }
@@ -179,7 +204,7 @@ function displayEntry(entry) {
 
     let kenjiSpellings = '';
     for (var k of entry.kanji_spellings || []) {
-        kenjiSpellings += `<span class="kanji_spelling">${k.kanji_spelling}</span>`;
+        kenjiSpellings += `<span class="kanji_spelling">${commonStar(k)}${k.kanji_spelling}</span>`;
     }
 
     let senses = '';
@@ -191,8 +216,17 @@ function displayEntry(entry) {
         </span>`;
     }
 
+    let primaryToggle = '';
+    if (primaryEntry !== undefined) {
+        let key = entryKey(entry);
+        let isPrimary = key === primaryEntry;
+        primaryToggle = `<a href="#" class="primary_entry_toggle ${isPrimary ? 'primary' : ''}" entry_key="${key}"
+            title="${isPrimary ? 'unset primary entry' : 'make this the primary entry'}">${isPrimary ? '◉' : '○'}</a>`;
+    }
+
     return `<div class="entry">
                 <div class="word">
+                    ${primaryToggle}
                     <div class="readings">${readings}</div>
                     <div class="kanji_spellings">${kenjiSpellings}</div>
                     <div class="senses">${senses}</div>
@@ -200,6 +234,98 @@ function displayEntry(entry) {
             </div>`;
 }
 
+function escapeHTML(str) {
+    return (str || '').replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+}
+
+// key presses in text fields shouldn't trigger the page's shortcuts
+function isTextInput(target) {
+    return target.tagName === 'TEXTAREA' || target.tagName === 'INPUT';
+}
+
+function displayWordNotes(baseForm, wordInfo) {
+    return `<form class="word_notes" base_form="${escapeHTML(baseForm)}">
+                <input type="text" name="gloss" placeholder="gloss" value="${escapeHTML(wordInfo.gloss)}">
+                <textarea name="note" placeholder="note">${escapeHTML(wordInfo.note)}</textarea>
+                <textarea name="mnemonic" placeholder="mnemonic">${escapeHTML(wordInfo.mnemonic)}</textarea>
+                <button type="submit">save</button>
+            </form>`;
+}
+
+// the notes and primary entry are sent together because the server replaces all of them
+function updateWordNote(baseForm, wordInfo, successFn) {
+    fetch('/word_note', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            base_form: baseForm,
+            note: wordInfo.note || '',
+            mnemonic: wordInfo.mnemonic || '',
+            gloss: wordInfo.gloss || '',
+            primary_entry: wordInfo.primary_entry || '',
+        }),
+    }).then((response) => response.json())
+        .then((data) => {
+            if (data.message) {
+                snackbarMessage(data.message);
+                return;
+            }
+            if (successFn) {
+                successFn(data);
+            }
+        })
+        .catch((error) => {
+            console.error('Error updating word note:', error);
+        });
+}
+
+// handles the notes form and primary entry stars displayed in the definitions div;
+// redisplayFn is called after the word info changes
+function addWordNoteHandlers(div, getWordInfo, redisplayFn) {
+    div.addEventListener('submit', function (evt) {
+        let form = evt.target.closest('.word_notes');
+        if (!form) {
+            return;
+        }
+        evt.preventDefault();
+        let baseForm = form.getAttribute('base_form');
+        let wordInfo = getWordInfo(baseForm);
+        if (!wordInfo) {
+            return;
+        }
+        wordInfo.gloss = form.elements['gloss'].value.trim();
+        wordInfo.note = form.elements['note'].value.trim();
+        wordInfo.mnemonic = form.elements['mnemonic'].value.trim();
+        updateWordNote(baseForm, wordInfo, () => {
+            snackbarMessage(`saved notes for <span class="snackbar_word">${baseForm}</span>`);
+        });
+    });
+
+    div.addEventListener('click', function (evt) {
+        let toggle = evt.target.closest('.primary_entry_toggle');
+        if (!toggle) {
+            return;
+        }
+        evt.preventDefault();
+        let baseForm = div.querySelector('.word_notes').getAttribute('base_form');
+        let wordInfo = getWordInfo(baseForm);
+        if (!wordInfo) {
+            return;
+        }
+        let key = toggle.getAttribute('entry_key');
+        wordInfo.primary_entry = (wordInfo.primary_entry === key) ? '' : key;
+        updateWordNote(baseForm, wordInfo, () => {
+            // put the primary entry first, as the server does
+            let primary = wordInfo.definitions.filter(x => entryKey(x) === wordInfo.primary_entry);
+            let rest = wordInfo.definitions.filter(x => entryKey(x) !== wordInfo.primary_entry);
+            wordInfo.definitions = primary.concat(rest);
+            redisplayFn(baseForm);
+        });
+    });
+}
+
 function updateStoryStatus(story, refreshList) {
     let temp = { ...story };
     delete temp.content;
@@ -263,6 +389,47 @@ function getStoryList(successFn) {
         });
 }
 
+function getQueue(limit, successFn) {
+    fetch(`/queue?limit=${limit}`, {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then((data) => {
+            successFn(data);
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+}
+
+function getWordReviews(baseForm, limit, successFn) {
+    fetch(`/word_reviews/${encodeURIComponent(baseForm)}?limit=${limit}`, {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then((data) => {
+            successFn(data);
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+}
+
+// accuracy and a row of the most recent outcomes, oldest on the left
+function displayReviewHistory(history) {
+    if (!history.reviews || history.reviews.length === 0) {
+        return '<div class="review_history">never drilled</div>';
+    }
+    let outcomes = history.reviews.slice().reverse().map(
+        (r) => r.correct ? '<span class="review_correct">✓</span>' : '<span class="review_wrong">✗</span>');
+    let accuracy = Math.round(history.accuracy * 100);
+    return `<div class="review_history">${accuracy}% of ${history.correct + history.wrong} reviews &nbsp; ${outcomes.join('')}</div>`;
+}
+
 function timeSince(date) {
     if (date === 0) {
         return 'never';
@@ -340,7 +507,7 @@ function timeSince(date) {
 const DRILL_ALL_CURRENT = -1;
 const DRILL_ALL = 0;
 
-function addLogEvent(storyId) {
+function addLogEvent(storyId, successFn) {
     fetch(`/add_log_event/${storyId}`, {
         method: 'GET',
         headers: {
@@ -350,6 +517,9 @@ function addLogEvent(storyId) {
         .then((data) => {
             console.log(data);
             snackbarMessage(data.message);
+            if (successFn && data.story) {
+                successFn(data);
+            }
         })
         .catch((error) => {
             console.error('Error:', error);
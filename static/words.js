@@ -9,6 +9,12 @@ var kanjiResultsDiv = document.getElementById('kanji_results');
 var filterSelect = document.getElementById('filter_select')
 var definitionsDiv = document.getElementById('definitions');
 var rankSlider = document.getElementById('rank_slider');
+var schedulerSelect = document.getElementById('scheduler_select');
+var clozeCheckbox = document.getElementById('cloze_checkbox');
+var drillStatsDetails = document.getElementById('drill_stats');
+var drillStatsDiv = document.getElementById('drill_stats_content');
+var leechesDetails = document.getElementById('leeches');
+var leechesDiv = document.getElementById('leeches_content');
 
 
 const COOLDOWN_TIME = 60 * 60 * 3 // number of seconds
@@ -18,61 +24,143 @@ var answeredSet = [];
 var stories;
 var words;
 var wordInfoMap;
+var drillStoryIds = [];
+var rankCount = 4; // replaced by the user's setting on load
 
+// the server filters the words and orders them with the longest overdue first
 function newDrill() {
-    let includeOffCooldown = true;
-    let includeOnCooldown = true;
-    switch (filterSelect.value) {
-        case 'off':
-            includeOnCooldown = false;
-            break;
-        case 'on':
-            includeOffCooldown = false;
-            break;
+    let [minRank, maxRank] = rankSlider.noUiSlider.get();
+    let drillingKanji = categorySelect.value === 'kanji';
+    if (clozeCheckbox.checked && !drillingKanji) {
+        newClozeDrill(parseInt(minRank), parseInt(maxRank));
+        return;
     }
 
-    let categoryMask = getCategoryMask(categorySelect.value);
-    let [minRank, maxRank] = rankSlider.noUiSlider.get();
-    let unixTime = Math.floor(Date.now() / 1000);
-
-    let countsByRank = [0, 0, 0, 0, 0];
-    let onCooldownCountsByRank = [0, 0, 0, 0, 0];
-
-    drillSet = [];
-    for (let word of words) {
-        let wordInfo = wordInfoMap[word.base_form];
-        let offcooldown = (unixTime - wordInfo.date_marked) > cooldownsByRank[wordInfo.rank];
-        countsByRank[wordInfo.rank]++;
-        if (offcooldown) {
-            onCooldownCountsByRank[wordInfo.rank]++;
-        }
+    fetch(drillingKanji ? '/drill_kanji' : 'words', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            story_ids: drillStoryIds,
+            filter: filterSelect.value,
+            category_mask: categorySelect.value === 'all' ? 0 : getCategoryMask(categorySelect.value),
+            min_rank: parseInt(minRank),
+            max_rank: parseInt(maxRank),
+        })
+    }).then((response) => response.json())
+        .then((data) => {
+            if (drillingKanji) {
+                data = kanjiDrillToWordDrill(data);
+            }
+            words = data.words;
+            wordInfoMap = data.wordInfoMap;
 
-        // filter
-        if (categorySelect.value === 'all' || (word.category & categoryMask) != 0) {
-            let wordInfo = wordInfoMap[word.base_form];
-            if (wordInfo.rank >= minRank && wordInfo.rank <= maxRank) {
-                if ((includeOffCooldown && includeOnCooldown) ||
-                    (includeOffCooldown && offcooldown) ||
-                    (includeOnCooldown && !offcooldown)
-                ) {
-                    word.answered = false;
-                    drillSet.push(word);
-                }
+            drillSet = [];
+            for (let word of words) {
+                word.answered = false;
+                drillSet.push(word);
             }
-        }
+
+            drillComlpeteDiv.style.display = 'none';
+            answeredSet = [];
+
+            let countsByRank = data.countsByRank;
+            let offCooldownCountsByRank = data.offCooldownCountsByRank;
+            let html = `${data.total} words in story`;
+            for (let rank = 1; rank < countsByRank.length; rank++) {
+                html += ` &nbsp;&nbsp;&nbsp;
+                        <span class="rank_number">Rank ${rank}:</span> ${countsByRank[rank]} words <span class="cooldown">(${offCooldownCountsByRank[rank]} off cooldown)</span>`;
+            }
+            drillInfoH.innerHTML = html;
+            displayWords();
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+}
+
+// each card shows a sentence from the user's stories with the word blanked out
+function newClozeDrill(minRank, maxRank) {
+    fetch('/cloze', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            story_ids: drillStoryIds,
+            category_mask: categorySelect.value === 'all' ? 0 : getCategoryMask(categorySelect.value),
+            min_rank: minRank,
+            max_rank: maxRank,
+        })
+    }).then((response) => response.json())
+        .then((data) => {
+            words = data.clozes.map((cloze) => ({ ...cloze.word, contexts: cloze.contexts }));
+            wordInfoMap = data.wordInfoMap;
+
+            drillSet = [];
+            for (let word of words) {
+                word.answered = false;
+                drillSet.push(word);
+            }
+
+            drillComlpeteDiv.style.display = 'none';
+            answeredSet = [];
+
+            drillInfoH.innerHTML = `${words.length} due words with sentences in your stories`;
+            displayWords();
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+}
+
+// kanji are drilled apart from words, so their cards are marked as kanji
+// to send their updates to /update_kanji
+function kanjiDrillToWordDrill(data) {
+    let words = [];
+    let wordInfoMap = {};
+    for (let kanji of data.kanji) {
+        words.push({
+            base_form: kanji.character,
+            rank: kanji.rank,
+            date_marked: kanji.date_marked,
+            drill_count: kanji.drill_count,
+            encounter_count: kanji.encounter_count,
+            due: kanji.due,
+            kanji: true,
+        });
+        wordInfoMap[kanji.character] = { rank: kanji.rank, date_marked: kanji.date_marked, due: kanji.due };
     }
+    return { ...data, words: words, wordInfoMap: wordInfoMap };
+}
 
-    drillComlpeteDiv.style.display = 'none';
-    shuffle(drillSet);
-    answeredSet = [];
-
-    drillInfoH.innerHTML = `
-                        ${words.length} words in story &nbsp;&nbsp;&nbsp;
-                        <span class="rank_number">Rank 1:</span> ${countsByRank[1]} words <span class="cooldown">(${onCooldownCountsByRank[1]} off cooldown)</span> &nbsp;&nbsp;&nbsp;
-                        <span class="rank_number">Rank 2:</span> ${countsByRank[2]} words <span class="cooldown">(${onCooldownCountsByRank[2]} off cooldown)</span> &nbsp;&nbsp;&nbsp;
-                        <span class="rank_number">Rank 3:</span> ${countsByRank[3]} words <span class="cooldown">(${onCooldownCountsByRank[3]} off cooldown)</span> &nbsp;&nbsp;&nbsp;
-                        <span class="rank_number">Rank 4:</span> ${countsByRank[4]} words <span class="cooldown">(${onCooldownCountsByRank[4]} off cooldown)</span>`;
-    displayWords();
+function updateDrillWord(word) {
+    if (!word.kanji) {
+        updateWord(word, wordInfoMap);
+        return;
+    }
+    fetch('/update_kanji', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            character: word.base_form,
+            rank: word.rank,
+            date_marked: word.date_marked,
+            answer: word.answer,
+        }),
+    }).then((response) => response.json()
+    ).then((data) => {
+        snackbarMessage(`kanji <span class="snackbar_word">${data.character}</span> set to rank ${data.rank}`);
+        let wordInfo = wordInfoMap[data.character];
+        wordInfo.rank = data.rank;
+        wordInfo.date_marked = data.date_marked;
+        wordInfo.due = data.due;
+    }).catch((error) => {
+        console.error('Error:', error);
+    });
 }
 
 const DRILL_CATEGORY_KATAKANA = 1;
@@ -105,12 +193,49 @@ function getCategoryMask(category) {
 }
 
 categorySelect.onchange = newDrill;
+clozeCheckbox.onchange = newDrill;
 filterSelect.onchange = newDrill;
 
+schedulerSelect.onchange = function (evt) {
+    fetch('/settings', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ scheduler: schedulerSelect.value }),
+    }).then((response) => response.json())
+        .then((data) => {
+            snackbarMessage(`words are now scheduled by ${schedulerSelect.selectedOptions[0].text}`);
+            newDrill();
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+};
+
+// the word itself is only shown once the card is answered
+function clozeInfo(word, idx) {
+    let html = `<div index="${idx}" class="drill_word cloze ${word.wrong ? 'wrong' : ''} ${word.answered ? 'answered' : ''}">
+                    <div class="cloze_contexts">`;
+    for (let context of word.contexts) {
+        html += `<div class="cloze_sentence">${context.sentence}
+                    <a class="cloze_source" href="/story.html?storyId=${context.story_id}">${context.story_title} ${context.timestamp}</a></div>`;
+    }
+    html += `</div>
+                    <div class="base_form">${word.answered ? word.base_form : ''}</div>
+                    <div class="rank rank${word.rank}"><span>rank</span> ${word.rank}</div>
+                </div>`;
+    return html;
+}
+
 function displayWords() {
     function wordInfo(word, idx, answered) {
+        if (word.contexts) {
+            return clozeInfo(word, idx);
+        }
         return `<div index="${idx}" class="drill_word ${word.wrong ? 'wrong' : ''} ${word.answered ? 'answered' : ''}">
                     <div class="base_form">${word.base_form}</div>
+                    ${word.leech ? '<div class="leech_badge" title="lapsed ' + word.lapses + ' times">leech</div>' : ''}
                     <div class="rank rank${word.rank}"><span>rank</span> ${word.rank}</div>
                 </div>`;
     }
@@ -136,11 +261,13 @@ function displayWords() {
 
     if (drillSet[0]) {
         loadWordDefinition(drillSet[0].base_form)
+        // the definitions would give away the blanked word until revealed with s
+        answerDiv.style.visibility = drillSet[0].contexts ? 'hidden' : 'visible';
     }
 }
 
 document.body.onkeydown = async function (evt) {
-    if (evt.ctrlKey) {
+    if (evt.ctrlKey || isTextInput(evt.target)) {
         return;
     }
     if ((evt.code === 'KeyR') && evt.altKey) {
@@ -153,37 +280,18 @@ document.body.onkeydown = async function (evt) {
         //console.log(evt.code);
         if (evt.code === 'KeyS') {
             evt.preventDefault();
+            answerDiv.style.visibility = 'visible';
             // showWord();
-        } else if (evt.code === 'Digit1') {
-            evt.preventDefault();
-            if (drillSet && drillSet[0]) {
-                var word = drillSet[0];
-                word.rank = 1;
-                updateWord(word, wordInfoMap);
-                displayWords();
-            }
-        } else if (evt.code === 'Digit2') {
-            evt.preventDefault();
-            if (drillSet && drillSet[0]) {
-                var word = drillSet[0];
-                word.rank = 2;
-                updateWord(word, wordInfoMap);
-                displayWords();
-            }
-        } else if (evt.code === 'Digit3') {
+        } else if (evt.code.startsWith('Digit')) {
             evt.preventDefault();
-            if (drillSet && drillSet[0]) {
-                var word = drillSet[0];
-                word.rank = 3;
-                updateWord(word, wordInfoMap);
-                displayWords();
+            let digit = parseInt(evt.code.slice(-1));
+            if (digit < 1 || digit > rankCount) {
+                return;
             }
-        } else if (evt.code === 'Digit4') {
-            evt.preventDefault();
             if (drillSet && drillSet[0]) {
                 var word = drillSet[0];
-                word.rank = 4;
-                updateWord(word, wordInfoMap);
+                word.rank = digit;
+                updateDrillWord(word);
                 displayWords();
             }
         } else if (evt.code === 'KeyA') {  // mark wrong and swap top two words
@@ -199,7 +307,7 @@ document.body.onkeydown = async function (evt) {
             if (unixtime - word.date_marked > COOLDOWN_TIME) {
                 word.date_marked = unixtime;
                 word.drill_count++;
-                updateWord(word, wordInfoMap);
+                updateDrillWord({ ...word, answer: word.wrong ? 'wrong' : 'correct' });
             }
             drillSet.shift();
             answeredSet.unshift(word);
@@ -255,14 +363,160 @@ function loadWordDefinition(baseForm) {
     let wordInfo = wordInfoMap[baseForm];
     if (wordInfo) {
         let defs = wordInfo.definitions;
-        html = '';
+        let word = drillSet[0];
+        let isKanji = word && word.kanji;
+        html = isKanji ? '' : displayWordNotes(baseForm, wordInfo);
         if (defs) {
             for (let def of defs) {
-                html += displayEntry(def);
+                html += displayEntry(def, isKanji ? undefined : (wordInfo.primary_entry || ''));
             }
         }
         definitionsDiv.innerHTML = html;
+        if (isKanji) {
+            definitionsDiv.innerHTML = `<div class="review_history">drilled ${word.drill_count} times,
+                encountered in ${word.encounter_count} drilled words</div>`;
+            return;
+        }
+        getWordReviews(baseForm, REVIEW_HISTORY_LIMIT, (history) => {
+            definitionsDiv.insertAdjacentHTML('afterbegin', displayReviewHistory(history));
+        });
+    }
+}
+
+addWordNoteHandlers(definitionsDiv, (baseForm) => wordInfoMap[baseForm], loadWordDefinition);
+
+const REVIEW_HISTORY_LIMIT = 36;
+
+// the stats are fetched each time the dashboard is opened so they include the latest answers
+drillStatsDetails.ontoggle = function (evt) {
+    if (!drillStatsDetails.open) {
+        return;
+    }
+    fetch('/drill_stats', {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then((data) => {
+            drillStatsDiv.innerHTML = displayDrillStats(data);
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+};
+
+leechesDetails.ontoggle = function (evt) {
+    if (leechesDetails.open) {
+        loadLeeches();
     }
+};
+
+function loadLeeches() {
+    fetch('/leeches', {
+        method: 'GET',
+        headers: {
+            'Content-Type': 'application/json',
+        }
+    }).then((response) => response.json())
+        .then((data) => {
+            leechesDiv.innerHTML = displayLeeches(data);
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+}
+
+function displayLeeches(leeches) {
+    if (leeches.length === 0) {
+        return 'no leeches';
+    }
+    let html = '<table id="leeches_table"><tr><th>word</th><th>lapses</th><th>accuracy</th><th>rank</th><th></th></tr>';
+    for (let leech of leeches) {
+        html += `<tr base_form="${leech.base_form}" class="${leech.suspended ? 'suspended' : ''}">
+            <td>${leech.base_form}</td>
+            <td>${leech.lapses}</td>
+            <td>${Math.round(leech.accuracy * 100)}%</td>
+            <td>${leech.rank}</td>
+            <td>
+                <a href="#" action="${leech.suspended ? 'unsuspend' : 'suspend'}">${leech.suspended ? 'unsuspend' : 'suspend'}</a>
+                <a href="#" action="clear" title="unsuspend and reset the lapses">clear</a>
+            </td>
+        </tr>`;
+    }
+    return html + '</table>';
+}
+
+leechesDiv.onclick = function (evt) {
+    let action = evt.target.getAttribute('action');
+    if (!action) {
+        return;
+    }
+    evt.preventDefault();
+    let baseForm = evt.target.closest('tr').getAttribute('base_form');
+    fetch('/update_leech', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+            base_form: baseForm,
+            suspended: action === 'suspend',
+            clear_leech: action === 'clear',
+        }),
+    }).then((response) => response.json())
+        .then((data) => {
+            snackbarMessage(`word <span class="snackbar_word">${baseForm}</span> ${action === 'clear' ? 'cleared' : action + 'ed'}`);
+            loadLeeches();
+        })
+        .catch((error) => {
+            console.error('Error:', error);
+        });
+};
+
+const STATS_WEEKS_SHOWN = 12;
+
+function displayDrillStats(stats) {
+    let html = `<div class="stats_section"><h4>${stats.total_words} words (${stats.suspended} suspended), ${stats.total_kanji} kanji</h4>`;
+    for (let rank = 1; rank < stats.counts_by_rank.length; rank++) {
+        html += `<span class="rank_number">Rank ${rank}:</span> ${stats.counts_by_rank[rank]} &nbsp;&nbsp;`;
+    }
+    html += '<br>';
+    for (let category in stats.counts_by_category) {
+        html += `<span class="rank_number">${category}:</span> ${stats.counts_by_category[category]} &nbsp;&nbsp;`;
+    }
+    html += '</div>';
+
+    let forecastLabels = stats.due_forecast.map((count, day) => day === 0 ? 'today' : `+${day}d`);
+    html += `<div class="stats_section"><h4>due: ${stats.overdue} overdue, then over the next ${stats.due_forecast.length} days</h4>
+        ${displayBarChart(stats.due_forecast, forecastLabels)}</div>`;
+
+    let weeks = stats.words_added_by_week.slice(-STATS_WEEKS_SHOWN);
+    let weekLabels = weeks.map((week) => new Date(week.week_start * 1000).toLocaleDateString(undefined, { month: 'numeric', day: 'numeric' }));
+    html += `<div class="stats_section"><h4>words added per week</h4>
+        ${displayBarChart(weeks.map((week) => week.count), weekLabels)}</div>`;
+
+    html += '<div class="stats_section"><h4>accuracy by rank</h4>';
+    if (stats.accuracy_by_rank.length === 0) {
+        html += 'no reviews yet';
+    }
+    for (let accuracy of stats.accuracy_by_rank) {
+        html += `<span class="rank_number">Rank ${accuracy.rank}:</span> ${Math.round(accuracy.accuracy * 100)}% of ${accuracy.total} &nbsp;&nbsp;`;
+    }
+    html += '</div>';
+    return html;
+}
+
+function displayBarChart(values, labels) {
+    let max = Math.max(1, ...values);
+    let html = '<div class="bar_chart">';
+    for (let i = 0; i < values.length; i++) {
+        html += `<div class="bar" title="${labels[i]}: ${values[i]}">
+            <div class="bar_fill" style="height: ${Math.round(values[i] / max * 100)}%"></div>
+            <div class="bar_label">${values[i]}</div>
+        </div>`;
+    }
+    return html + '</div>';
 }
 
 function showWord() {
@@ -273,19 +527,29 @@ function showWord() {
 document.body.onload = function (evt) {
     console.log('on page load');
 
+    getSettings((data) => {
+        schedulerSelect.value = data.scheduler;
+        rankCount = data.rank_count;
+        createRankSlider(rankCount);
+        fetchStories();
+    });
+};
+
+// the slider spans the user's ranks, so it's created once the settings are loaded
+function createRankSlider(rankCount) {
     noUiSlider.create(rankSlider, {
-        start: [1, 4],
+        start: [1, rankCount],
         step: 1,
         connect: true,
         pips: {
             mode: 'count',
-            values: 4,
+            values: rankCount,
             density: 1,
             stepped: true
         },
         range: {
             'min': 1,
-            'max': 4
+            'max': rankCount
         },
         format: {
             // 'to' the formatted value. Receives a number.
@@ -299,11 +563,13 @@ document.body.onload = function (evt) {
             }
         }
     });
+}
 
-    function sliderUpdate(values, handle, unencoded, tap, positions, noUiSlider) {
-        newDrill();
-    }
+function sliderUpdate(values, handle, unencoded, tap, positions, noUiSlider) {
+    newDrill();
+}
 
+function fetchStories() {
     fetch('/stories_list', {
         method: 'GET', // or 'PUT'
         headers: {
@@ -341,27 +607,10 @@ document.body.onload = function (evt) {
 
             drillTitleH.innerHTML = `<a href="/story.html?storyId=${ids}"> ${titles.join(', ')}</a>`;
 
-            fetch('words', {
-                method: 'POST', // or 'PUT'
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({
-                    story_ids: ids,
-                })
-            }).then((response) => response.json())
-                .then((data) => {
-                    //console.log('Words retrieved:', data);
-                    words = data.words;
-                    wordInfoMap = data.wordInfoMap;
-
-                    rankSlider.noUiSlider.on('update', sliderUpdate);  // calls newDrill upon registration
-                })
-                .catch((error) => {
-                    console.error('Error:', error);
-                });
+            drillStoryIds = ids;
+            rankSlider.noUiSlider.on('update', sliderUpdate);  // calls newDrill upon registration
         })
         .catch((error) => {
             console.error('Error:', error);
         });
-};
\ No newline at end of file
+}